@@ -0,0 +1,51 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	jitterRand  = rand.New(rand.NewSource(time.Now().UnixNano()))
+	jitterMutex sync.Mutex
+)
+
+// backoff defines an exponential backoff with full jitter.
+// The delay of the n-th retry is chosen randomly between zero and min(max, base * 2^n).
+type backoff struct {
+	attempt int
+	mutex   sync.Mutex
+}
+
+// next returns the delay of the next retry and increases the attempt count.
+func (b *backoff) next(base, max time.Duration) time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	ceiling := base
+	for i := 0; i < b.attempt && ceiling < max; i++ {
+		ceiling *= 2
+	}
+	if ceiling > max {
+		ceiling = max
+	}
+	b.attempt++
+	if ceiling <= 0 {
+		return 0
+	}
+	jitterMutex.Lock()
+	defer jitterMutex.Unlock()
+	return time.Duration(jitterRand.Int63n(int64(ceiling) + 1))
+}
+
+// reset resets the attempt count after a success.
+func (b *backoff) reset() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.attempt = 0
+}
+
+// retryDelay returns the delay of the next retry by the configured seconds.
+func (b *backoff) retryDelay(baseSec, maxSec int) time.Duration {
+	return b.next(time.Duration(baseSec)*time.Second, time.Duration(maxSec)*time.Second)
+}
@@ -4,86 +4,314 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"os"
+	"path/filepath"
 	"runtime"
+	"sync/atomic"
 )
 
 // Config defines all of configuration parameters.
 type Config struct {
-	APIKey              string `json:"api_key"`
-	CustomID            string `json:"custom_id"`
-	Server              string `json:"server"`
-	ReportIntervalMin   int    `json:"report_interval_min"`
-	PayloadCommand      string `json:"payload_command"`
-	SSHEnabled          bool   `json:"ssh_enabled"`
-	SSHLocalHost        string `json:"ssh_local_host"`
-	SSHLocalPort        int    `json:"ssh_local_port"`
-	SSHRetryGapSec      int    `json:"ssh_retry_gap_sec"`
-	RTTEnabled          bool   `json:"rtt_enabled"`
-	ThroughputEnabled   bool   `json:"throughput_enabled"`
-	ThroughputKB        int    `json:"throughput_kb"`
-	DiskUsageEnabled    bool   `json:"disk_usage_enabled"`
-	DiskUsageMountPoint string `json:"disk_usage_mount_point"`
-	USBScanEnabled      bool   `json:"usb_scan_enabled"`
-	BTScanEnabled       bool   `json:"bt_scan_enabled"`
-	UpdateEnabled       bool   `json:"update_enabled"`
-	UpdateCheckURL      string `json:"update_check_url"`
-	UpdateCommand       string `json:"update_command"`
+	APIKey                 string       `json:"api_key"`
+	CustomID               string       `json:"custom_id"`
+	IDInterface            string       `json:"id_interface"`
+	IDExcludeInterfaces    []string     `json:"id_exclude_interfaces"`
+	IDPreferPhysical       bool         `json:"id_prefer_physical"`
+	Server                 string       `json:"server"`
+	ReportIntervalMin      int          `json:"report_interval_min"`
+	PayloadCommand         string       `json:"payload_command"`
+	SSHEnabled             bool         `json:"ssh_enabled"`
+	SSHLocalHost           string       `json:"ssh_local_host"`
+	SSHLocalPort           int          `json:"ssh_local_port"`
+	SSHRetryGapSec         int          `json:"ssh_retry_gap_sec"`
+	SSHRetryMaxSec         int          `json:"ssh_retry_max_sec"`
+	SSHHostKeyCheck        string       `json:"ssh_host_key_check"`
+	SSHKnownHostsFile      string       `json:"ssh_known_hosts_file"`
+	SSHForwards            []sshForward `json:"ssh_forwards"`
+	SSHIdleTimeoutMin      int          `json:"ssh_idle_timeout_min"`
+	SSHSwitchGraceSec      int          `json:"ssh_switch_grace_sec"`
+	SSHKeepaliveSec        int          `json:"ssh_keepalive_sec"`
+	SSHKeepaliveMax        int          `json:"ssh_keepalive_max_failures"`
+	RTTEnabled             bool         `json:"rtt_enabled"`
+	ThroughputEnabled      bool         `json:"throughput_enabled"`
+	ThroughputKB           int          `json:"throughput_kb"`
+	DiskUsageEnabled       bool         `json:"disk_usage_enabled"`
+	DiskUsageMountPoint    string       `json:"disk_usage_mount_point"`
+	DiskUsageMountPoints   []string     `json:"disk_usage_mount_points"`
+	DiskUsageAllMounts     bool         `json:"disk_usage_all_mounts"`
+	SystemMetricsEnabled   bool         `json:"system_metrics_enabled"`
+	SensorsEnabled         bool         `json:"sensors_enabled"`
+	InterfacesEnabled      bool         `json:"network_interfaces_enabled"`
+	USBScanEnabled         bool         `json:"usb_scan_enabled"`
+	BTScanEnabled          bool         `json:"bt_scan_enabled"`
+	UpdateEnabled          bool         `json:"update_enabled"`
+	UpdateCheckURL         string       `json:"update_check_url"`
+	UpdateCommand          string       `json:"update_command"`
+	UpdatePublicKeys       []string     `json:"update_public_keys"`
+	UpdateProbationMin     int          `json:"update_probation_min"`
+	UpdateProbationReports int          `json:"update_probation_reports"`
+	UpdateRetryMinSec      int          `json:"update_retry_min_sec"`
+	UpdateRetryMaxSec      int          `json:"update_retry_max_sec"`
+	UploadRetryMinSec      int          `json:"upload_retry_min_sec"`
+	UploadRetryMaxSec      int          `json:"upload_retry_max_sec"`
+	RebootCommand          string       `json:"reboot_command"`
+	DataDir                string       `json:"data_dir"`
+	SpoolEnabled           bool         `json:"spool_enabled"`
+	SpoolDir               string       `json:"spool_dir"`
+	SpoolMaxEntries        int          `json:"spool_max_entries"`
+	SpoolMaxKB             int          `json:"spool_max_kb"`
+	JobsEnabled            bool         `json:"jobs_enabled"`
+	JobAllowlist           []string     `json:"job_allowlist"`
+	JobMaxTimeoutSec       int          `json:"job_max_timeout_sec"`
+	JobMaxOutputKB         int          `json:"job_max_output_kb"`
+	RemoteConfigEnabled    bool         `json:"remote_config_enabled"`
+	EventsEnabled          bool         `json:"events_enabled"`
+	EventPollSec           int          `json:"event_poll_sec"`
+	EventDebounceSec       int          `json:"event_debounce_sec"`
+	EventMinGapSec         int          `json:"event_min_gap_sec"`
+	LocalAPIEnabled        bool         `json:"local_api_enabled"`
+	LocalAPIListen         string       `json:"local_api_listen"`
+	MetricsListen          string       `json:"metrics_listen"`
+	Transport              string       `json:"transport"`
+	MQTTBroker             string       `json:"mqtt_broker"`
+	MQTTUsername           string       `json:"mqtt_username"`
+	MQTTPassword           string       `json:"mqtt_password"`
+	MQTTCAFile             string       `json:"mqtt_ca_file"`
+	MQTTReportTopic        string       `json:"mqtt_report_topic"`
+	MQTTReplyTopic         string       `json:"mqtt_reply_topic"`
+	MQTTQoS                int          `json:"mqtt_qos"`
+	ControlEnabled         bool         `json:"control_enabled"`
+	ControlPath            string       `json:"control_path"`
+	ControlRetryMinSec     int          `json:"control_retry_min_sec"`
+	ControlRetryMaxSec     int          `json:"control_retry_max_sec"`
+	Version                string       `json:"-"` // Version of the applied remote configuration
 }
 
-var config = Config{
-	ReportIntervalMin:   3,
-	SSHEnabled:          true,
-	SSHLocalHost:        "localhost",
-	SSHLocalPort:        22,
-	SSHRetryGapSec:      10,
-	RTTEnabled:          true,
-	ThroughputKB:        500,
-	DiskUsageMountPoint: "/",
-	UpdateEnabled:       true,
-	UpdateCheckURL:      "https://kaginawa.github.io/LATEST",
+var defaultConfig = Config{
+	IDExcludeInterfaces:    []string{"docker*", "veth*", "br-*", "virbr*"},
+	IDPreferPhysical:       true,
+	ReportIntervalMin:      3,
+	SSHEnabled:             true,
+	SSHLocalHost:           "localhost",
+	SSHLocalPort:           22,
+	SSHRetryGapSec:         10,
+	SSHRetryMaxSec:         600,
+	SSHIdleTimeoutMin:      30,
+	SSHSwitchGraceSec:      60,
+	SSHKeepaliveSec:        30,
+	SSHKeepaliveMax:        3,
+	SSHHostKeyCheck:        hostKeyCheckAuto,
+	RTTEnabled:             true,
+	ThroughputKB:           500,
+	DiskUsageMountPoint:    "/",
+	InterfacesEnabled:      true,
+	UpdateEnabled:          true,
+	UpdateCheckURL:         "https://kaginawa.github.io/LATEST",
+	UpdateProbationMin:     30,
+	UpdateProbationReports: 3,
+	UpdateRetryMinSec:      60,
+	UpdateRetryMaxSec:      3600,
+	UploadRetryMinSec:      10,
+	UploadRetryMaxSec:      600,
+	SpoolEnabled:           true,
+	SpoolMaxEntries:        1000,
+	SpoolMaxKB:             10240,
+	JobMaxTimeoutSec:       300,
+	JobMaxOutputKB:         64,
+	RemoteConfigEnabled:    true,
+	EventPollSec:           5,
+	EventDebounceSec:       10,
+	EventMinGapSec:         60,
+	LocalAPIListen:         "localhost:8870",
+	Transport:              transportHTTP,
+	MQTTReportTopic:        "kaginawa/{id}/report",
+	MQTTReplyTopic:         "kaginawa/{id}/reply",
+	MQTTQoS:                1,
+	ControlPath:            "/control",
+	ControlRetryMinSec:     5,
+	ControlRetryMaxSec:     300,
 }
 
-// loadConfig loads configuration file from default or specified path.
+var activeConfig atomic.Pointer[Config]
+
+// config returns the active configuration. Returned value must not be modified.
+func config() *Config {
+	if c := activeConfig.Load(); c != nil {
+		return c
+	}
+	return &defaultConfig
+}
+
+// loadConfig loads configuration file from default or specified path, and activates it.
 func loadConfig(path string) error {
+	c, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+	activeConfig.Store(c)
+	return nil
+}
+
+// readConfig reads configuration file from default or specified path, and applies the remote configuration.
+func readConfig(path string) (*Config, error) {
+	c, err := readLocalConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if !c.RemoteConfigEnabled {
+		return c, nil
+	}
+	o, err := loadConfigOverride(c)
+	if err != nil {
+		log.Printf("remote configuration ignored: %v", err)
+		return c, nil
+	}
+	if o == nil {
+		return c, nil
+	}
+	rc, err := o.apply(c)
+	if err != nil {
+		log.Printf("remote configuration %s ignored: %v", o.Version, err)
+		return c, nil
+	}
+	return rc, nil
+}
+
+// readLocalConfig reads configuration file from default or specified path.
+func readLocalConfig(path string) (*Config, error) {
 	if len(path) == 0 {
 		path = defaultConfigFilePath
 	}
 
 	// Load file
 	if _, err := os.Stat(path); err != nil {
-		return fmt.Errorf("configuration file not found: %s", path)
+		return nil, fmt.Errorf("configuration file not found: %s", path)
 	}
 	data, err := os.ReadFile(path)
 	if err != nil {
-		return fmt.Errorf("failed to load %s: %w", path, err)
+		return nil, fmt.Errorf("failed to load %s: %w", path, err)
 	}
 
 	// Set OS-specific default value
+	c := defaultConfig.clone()
 	switch runtime.GOOS {
 	case "darwin":
-		config.DiskUsageEnabled = true
+		c.RebootCommand = "sudo shutdown -r now"
+		c.DiskUsageEnabled = true
 	case "linux":
-		config.UpdateCommand = "sudo service kaginawa restart"
-		config.DiskUsageEnabled = true
+		c.UpdateCommand = "sudo service kaginawa restart"
+		c.RebootCommand = "sudo reboot"
+		c.DiskUsageEnabled = true
+		c.SystemMetricsEnabled = true
+		c.EventsEnabled = true
+	case "windows":
+		c.RebootCommand = "shutdown /r /t 0"
 	}
 
 	// Parse file
-	if err := json.Unmarshal(data, &config); err != nil {
-		return fmt.Errorf("failed to parse %s: %w", path, err)
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
 	}
 
 	// Validation
-	if len(config.APIKey) == 0 {
-		return errors.New("no api key configured")
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// validate validates required and ranged parameters.
+func (c Config) validate() error {
+	switch c.Transport {
+	case transportHTTP:
+		if len(c.APIKey) == 0 {
+			return errors.New("no api key configured")
+		}
+		if len(c.Server) == 0 {
+			return errors.New("no server configured")
+		}
+	case transportMQTT:
+		if len(c.MQTTBroker) == 0 {
+			return errors.New("no mqtt broker configured")
+		}
+		if c.MQTTQoS < 0 || c.MQTTQoS > 2 {
+			return errors.New("mqtt_qos must be 0, 1 or 2")
+		}
+	default:
+		return fmt.Errorf("unknown transport: %s", c.Transport)
+	}
+	if c.ReportIntervalMin <= 0 {
+		return errors.New("report_interval_min must be positive")
+	}
+	if c.SSHEnabled {
+		if err := validateRetry("ssh_retry_gap_sec", "ssh_retry_max_sec", c.SSHRetryGapSec, c.SSHRetryMaxSec); err != nil {
+			return err
+		}
+	}
+	if c.UpdateEnabled {
+		if err := validateRetry("update_retry_min_sec", "update_retry_max_sec", c.UpdateRetryMinSec, c.UpdateRetryMaxSec); err != nil {
+			return err
+		}
+	}
+	if c.UploadRetryMinSec > 0 { // zero disables upload retries
+		if err := validateRetry("upload_retry_min_sec", "upload_retry_max_sec", c.UploadRetryMinSec, c.UploadRetryMaxSec); err != nil {
+			return err
+		}
+	}
+	if c.ControlEnabled {
+		if err := validateRetry("control_retry_min_sec", "control_retry_max_sec", c.ControlRetryMinSec, c.ControlRetryMaxSec); err != nil {
+			return err
+		}
+	}
+	if c.SSHKeepaliveSec > 0 && c.SSHKeepaliveMax <= 0 {
+		return errors.New("ssh_keepalive_max_failures must be positive")
+	}
+	if c.SpoolEnabled && c.SpoolMaxEntries <= 0 {
+		return errors.New("spool_max_entries must be positive")
+	}
+	if c.SpoolEnabled && c.SpoolMaxKB <= 0 {
+		return errors.New("spool_max_kb must be positive")
 	}
-	if len(config.Server) == 0 {
-		return errors.New("no server configured")
+	if c.JobsEnabled && c.JobMaxTimeoutSec <= 0 {
+		return errors.New("job_max_timeout_sec must be positive")
+	}
+	if c.EventsEnabled && c.EventPollSec <= 0 {
+		return errors.New("event_poll_sec must be positive")
+	}
+	return nil
+}
+
+// validateRetry validates the minimum and maximum delays of a retry backoff.
+func validateRetry(minKey, maxKey string, minSec, maxSec int) error {
+	if minSec <= 0 || maxSec < minSec {
+		return fmt.Errorf("%s must be positive and not greater than %s", minKey, maxKey)
 	}
 	return nil
 }
 
+// clone returns a copy of the configuration which does not share slices with the original.
+// json.Unmarshal reuses the backing array of a non-nil slice, so decoding into a shallow copy overwrites the original.
+func (c Config) clone() Config {
+	c.IDExcludeInterfaces = append([]string(nil), c.IDExcludeInterfaces...)
+	c.SSHForwards = append([]sshForward(nil), c.SSHForwards...)
+	c.DiskUsageMountPoints = append([]string(nil), c.DiskUsageMountPoints...)
+	c.UpdatePublicKeys = append([]string(nil), c.UpdatePublicKeys...)
+	c.JobAllowlist = append([]string(nil), c.JobAllowlist...)
+	return c
+}
+
 // SSHLocal returns SSH local host and port with colon separator.
 func (c Config) SSHLocal() string {
 	return fmt.Sprintf("%s:%d", c.SSHLocalHost, c.SSHLocalPort)
 }
+
+// DataPath returns path of the named state file in the data directory.
+// The directory of the configuration file is used if data_dir is not configured.
+func (c Config) DataPath(name string) string {
+	dir := c.DataDir
+	if len(dir) == 0 {
+		dir = filepath.Dir(*configPath)
+	}
+	return filepath.Join(dir, name)
+}
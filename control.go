@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	controlCommandReply  = "reply"  // Handle the reply-style message
+	controlCommandReport = "report" // Upload a report immediately
+	controlCommandUpdate = "update" // Check and apply update immediately
+	controlPingGap       = 30 * time.Second
+	controlPongTimeout   = 90 * time.Second
+	controlWriteTimeout  = 10 * time.Second
+	controlStableTime    = time.Minute // Connection lifetime to reset the reconnect backoff
+)
+
+// controlMessage defines a command pushed by the server through the control channel.
+type controlMessage struct {
+	ID      string `json:"id"`              // Unique ID of the message, echoed back by the acknowledgement
+	Command string `json:"command"`         // Command type (reply, report or update)
+	Reply   *reply `json:"reply,omitempty"` // Reply-style instructions of the reply command
+}
+
+// controlAck defines an acknowledgement of a control message.
+type controlAck struct {
+	ID      string `json:"id"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+var (
+	controlStop      chan struct{}
+	controlMutex     sync.Mutex
+	controlConnected atomic.Bool
+)
+
+// startControl starts the control channel if not started.
+func startControl() {
+	controlMutex.Lock()
+	defer controlMutex.Unlock()
+	if controlStop != nil {
+		return
+	}
+	controlStop = make(chan struct{})
+	go controlLoop(controlStop)
+}
+
+// stopControl stops the running control channel.
+func stopControl() {
+	controlMutex.Lock()
+	defer controlMutex.Unlock()
+	if controlStop == nil {
+		return
+	}
+	close(controlStop)
+	controlStop = nil
+}
+
+// restartControl reconnects the running control channel, to register the changed device ID.
+func restartControl() {
+	controlMutex.Lock()
+	defer controlMutex.Unlock()
+	if controlStop == nil {
+		return
+	}
+	close(controlStop)
+	controlStop = make(chan struct{})
+	go controlLoop(controlStop)
+}
+
+// controlLoop keeps the control channel connected, reconnecting with exponential backoff and jitter.
+// Reports are still uploaded by the timer while the channel is down.
+func controlLoop(stop chan struct{}) {
+	var retry backoff
+	for {
+		begin := time.Now()
+		err := openControl(stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if time.Since(begin) > controlStableTime {
+			retry.reset()
+		}
+		delay := retry.retryDelay(config().ControlRetryMinSec, config().ControlRetryMaxSec)
+		log.Printf("control channel closed: %v, reconnecting after %v...", err, delay.Round(time.Second))
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// openControl connects to the control endpoint of the server and handles messages until disconnected.
+func openControl(stop chan struct{}) error {
+	conn, err := dialControl()
+	if err != nil {
+		return err
+	}
+	defer safeClose(conn, "control channel")
+	controlConnected.Store(true)
+	defer controlConnected.Store(false)
+	log.Printf("control channel connected: %s", conn.RemoteAddr())
+
+	var writeMutex sync.Mutex
+	write := func(messageType int, data []byte) error {
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+		if err := conn.SetWriteDeadline(time.Now().Add(controlWriteTimeout)); err != nil {
+			return err
+		}
+		return conn.WriteMessage(messageType, data)
+	}
+
+	// Keep alive
+	if err := conn.SetReadDeadline(time.Now().Add(controlPongTimeout)); err != nil {
+		return err
+	}
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(controlPongTimeout))
+	})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(controlPingGap)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-stop:
+				_ = write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				_ = conn.SetReadDeadline(time.Now()) // unblock the message loop
+				return
+			case <-ticker.C:
+				if err := write(websocket.PingMessage, nil); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	// Message loop
+	for {
+		var m controlMessage
+		if err := conn.ReadJSON(&m); err != nil {
+			return fmt.Errorf("failed to read control message: %w", err)
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(controlPongTimeout)); err != nil {
+			return err
+		}
+		result := controlAck{ID: m.ID, Success: true}
+		if err := handleControlMessage(m); err != nil {
+			result.Success = false
+			result.Error = err.Error()
+		}
+		data, err := json.Marshal(result)
+		if err != nil {
+			return fmt.Errorf("failed to marshal acknowledgement: %w", err)
+		}
+		if err := write(websocket.TextMessage, data); err != nil {
+			return fmt.Errorf("failed to send acknowledgement: %w", err)
+		}
+	}
+}
+
+// dialControl connects to the control endpoint with wss, falling back to ws except for localhost.
+func dialControl() (*websocket.Conn, error) {
+	if len(config().Server) == 0 {
+		return nil, errors.New("no server configured")
+	}
+	header := http.Header{}
+	header.Set("Authorization", "token "+config().APIKey)
+	query := url.Values{"id": {device().ID}}.Encode()
+	schemes := []string{"wss", "ws"}
+	if strings.Contains(config().Server, "localhost") {
+		schemes = []string{"ws"}
+	}
+	var err error
+	for _, scheme := range schemes {
+		var conn *websocket.Conn
+		var resp *http.Response
+		conn, resp, err = websocket.DefaultDialer.Dial(scheme+"://"+config().Server+config().ControlPath+"?"+query, header)
+		if err == nil {
+			return conn, nil
+		}
+		if resp != nil {
+			return nil, fmt.Errorf("failed to connect control channel with %s: HTTP %d", scheme, resp.StatusCode)
+		}
+		err = fmt.Errorf("failed to connect control channel with %s: %w", scheme, err)
+	}
+	return nil, err
+}
+
+// handleControlMessage executes the command of the control message.
+func handleControlMessage(m controlMessage) error {
+	log.Printf("control message received: %s (%s)", m.Command, m.ID)
+	switch m.Command {
+	case controlCommandReply:
+		if m.Reply == nil {
+			return errors.New("no reply content")
+		}
+		handleReply(*m.Reply)
+	case controlCommandReport:
+		go doReport(triggerControl)
+	case controlCommandUpdate:
+		if !config().UpdateEnabled {
+			return errors.New("automatic update disabled")
+		}
+		go func() {
+			if _, err := checkAndUpdate(); err != nil {
+				log.Printf("update failed: %v", err)
+			}
+		}()
+	default:
+		return fmt.Errorf("unknown command: %s", m.Command)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// mount defines an entry of the mounts file.
+type mount struct {
+	device     string
+	mountPoint string
+	filesystem string
+	readOnly   bool
+}
+
+// fsStat defines usages of a filesystem obtained by the statfs syscall.
+type fsStat struct {
+	totalBytes  int64
+	usedBytes   int64
+	inodesTotal int64
+	inodesUsed  int64
+	readOnly    bool
+}
+
+// Filesystems backed by block devices but not worth to report.
+var ignoredFilesystems = map[string]bool{
+	"squashfs": true, // snap packages and read-only images
+	"iso9660":  true,
+}
+
+// readMounts reads all entries of the mounts file such as /proc/self/mounts.
+func readMounts(path string) ([]mount, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer safeClose(f, path)
+	var mounts []mount
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		m := mount{
+			device:     unescapeMountField(fields[0]),
+			mountPoint: unescapeMountField(fields[1]),
+			filesystem: fields[2],
+		}
+		for _, option := range strings.Split(fields[3], ",") {
+			if option == "ro" {
+				m.readOnly = true
+			}
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, scanner.Err()
+}
+
+// realMounts returns mounts of block devices, excluding pseudo filesystems and bind mounts of the same device.
+func realMounts(mounts []mount) []mount {
+	var list []mount
+	seen := make(map[string]bool)
+	for _, m := range mounts {
+		if !strings.HasPrefix(m.device, "/dev/") || ignoredFilesystems[m.filesystem] || seen[m.device] {
+			continue
+		}
+		seen[m.device] = true
+		list = append(list, m)
+	}
+	return list
+}
+
+// findMount returns the mount containing the path. The last entry wins if the mount point is stacked.
+// It returns a mount of the path itself if no entry matches.
+func findMount(mounts []mount, path string) mount {
+	path = filepath.Clean(path)
+	found := mount{mountPoint: path}
+	matched := -1
+	for _, m := range mounts {
+		if m.mountPoint != path && m.mountPoint != "/" && !strings.HasPrefix(path, m.mountPoint+"/") {
+			continue
+		}
+		if len(m.mountPoint) >= matched {
+			found = m
+			matched = len(m.mountPoint)
+		}
+	}
+	return found
+}
+
+// unescapeMountField decodes octal escapes of the mounts file (ex. \040 for space).
+func unescapeMountField(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
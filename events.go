@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	pendingEvents      []string
+	pendingEventsMutex sync.Mutex
+	eventReportTimer   *time.Timer
+	lastEventReport    time.Time // Time of the last event report, guarded by pendingEventsMutex
+)
+
+// watchEvents polls USB devices, network interfaces and mounts, and reports changes immediately.
+// Changes detected within the debounce period are sent together in a report.
+func watchEvents() {
+	var last map[string]string
+	for {
+		if !config().EventsEnabled {
+			last = nil
+			time.Sleep(configWatchGapSec * time.Second)
+			continue
+		}
+		current := eventSnapshot()
+		if last != nil {
+			if events := diffSnapshot(last, current); len(events) > 0 {
+				queueEvents(events)
+			}
+		}
+		last = current
+		time.Sleep(time.Duration(config().EventPollSec) * time.Second)
+	}
+}
+
+// eventSnapshot collects the current state of watched resources as description by key.
+func eventSnapshot() map[string]string {
+	snapshot := make(map[string]string)
+	if adapters, err := net.Interfaces(); err == nil {
+		for _, adapter := range adapters {
+			if excludedAdapter(adapter.Name) {
+				continue // virtual interfaces churned by containers
+			}
+			state := "down"
+			if adapter.Flags&net.FlagUp != 0 {
+				state = "up"
+			}
+			if operState := readString(filepath.Join(sysfsRoot, "class", "net", adapter.Name, "operstate")); len(operState) > 0 {
+				state = operState
+			}
+			snapshot["link "+adapter.Name] = state
+			var addresses []string
+			if list, err := adapter.Addrs(); err == nil {
+				for _, address := range list {
+					addresses = append(addresses, address.String())
+				}
+			}
+			if len(addresses) > 0 {
+				sort.Strings(addresses)
+				snapshot["address "+adapter.Name] = strings.Join(addresses, " ")
+			}
+		}
+	}
+	if runtime.GOOS != "linux" {
+		return snapshot
+	}
+	if devices, err := usbSysfsDevices(sysfsRoot); err == nil {
+		for _, device := range devices {
+			key := fmt.Sprintf("usb %d-%s", device.Bus, device.PortPath)
+			snapshot[key] = strings.TrimSpace(device.VendorID + ":" + device.ProductID + " " + device.Name)
+		}
+	}
+	if mounts, err := readMounts(filepath.Join(procRoot, "self", "mounts")); err == nil {
+		for _, m := range realMounts(mounts) {
+			mode := "rw"
+			if m.readOnly {
+				mode = "ro"
+			}
+			snapshot["mount "+m.mountPoint] = fmt.Sprintf("%s %s %s", m.device, m.filesystem, mode)
+		}
+	}
+	return snapshot
+}
+
+// diffSnapshot describes added, removed and changed resources in sorted order.
+func diffSnapshot(prev, current map[string]string) []string {
+	var events []string
+	for key, value := range current {
+		old, found := prev[key]
+		switch {
+		case !found:
+			events = append(events, fmt.Sprintf("%s added: %s", key, value))
+		case old != value:
+			events = append(events, fmt.Sprintf("%s changed: %s -> %s", key, old, value))
+		}
+	}
+	for key, value := range prev {
+		if _, found := current[key]; !found {
+			events = append(events, fmt.Sprintf("%s removed: %s", key, value))
+		}
+	}
+	sort.Strings(events)
+	return events
+}
+
+// queueEvents records the events and schedules an event report after the debounce period.
+// Event reports are delayed further to keep the minimum gap from the last event report.
+func queueEvents(events []string) {
+	pendingEventsMutex.Lock()
+	defer pendingEventsMutex.Unlock()
+	for _, event := range events {
+		log.Printf("event: %s", event)
+	}
+	pendingEvents = append(pendingEvents, events...)
+	if eventReportTimer == nil {
+		delay := time.Duration(config().EventDebounceSec) * time.Second
+		if wait := time.Until(lastEventReport.Add(time.Duration(config().EventMinGapSec) * time.Second)); wait > delay {
+			delay = wait
+		}
+		eventReportTimer = time.AfterFunc(delay, func() {
+			pendingEventsMutex.Lock()
+			lastEventReport = time.Now()
+			pendingEventsMutex.Unlock()
+			doReport(triggerEvent)
+		})
+	}
+}
+
+// takeEvents returns and clears the pending events. A scheduled event report is canceled if not fired yet.
+func takeEvents() []string {
+	pendingEventsMutex.Lock()
+	defer pendingEventsMutex.Unlock()
+	events := pendingEvents
+	pendingEvents = nil
+	if eventReportTimer != nil {
+		eventReportTimer.Stop()
+		eventReportTimer = nil
+	}
+	return events
+}
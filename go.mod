@@ -2,6 +2,14 @@ module github.com/kaginawa/kaginawa
 
 go 1.19
 
-require golang.org/x/crypto v0.12.0
+require (
+	github.com/eclipse/paho.mqtt.golang v1.4.3
+	github.com/gorilla/websocket v1.5.0
+	golang.org/x/crypto v0.12.0
+)
 
-require golang.org/x/sys v0.11.0 // indirect
+require (
+	golang.org/x/net v0.10.0 // indirect
+	golang.org/x/sync v0.1.0 // indirect
+	golang.org/x/sys v0.11.0 // indirect
+)
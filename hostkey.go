@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const tofuKnownHostsFileName = "ssh_known_hosts"
+
+// Host key checking modes of the SSH server.
+const (
+	hostKeyCheckAuto        = "auto"        // fingerprint if provided, known_hosts if configured, otherwise tofu
+	hostKeyCheckFingerprint = "fingerprint" // pinned fingerprint provided by the server reply
+	hostKeyCheckKnownHosts  = "known_hosts" // local known_hosts file
+	hostKeyCheckTOFU        = "tofu"        // trust on first use, saved to the data directory
+	hostKeyCheckNone        = "none"        // no verification (insecure)
+)
+
+// hostKeyCallback returns the host key verification method for the SSH server specified by the reply.
+func hostKeyCallback(r reply) (ssh.HostKeyCallback, error) {
+	mode := config().SSHHostKeyCheck
+	if mode == hostKeyCheckAuto {
+		switch {
+		case len(r.SSHHostKey) > 0:
+			mode = hostKeyCheckFingerprint
+		case len(config().SSHKnownHostsFile) > 0:
+			mode = hostKeyCheckKnownHosts
+		default:
+			mode = hostKeyCheckTOFU
+		}
+	}
+	switch mode {
+	case hostKeyCheckFingerprint:
+		if len(r.SSHHostKey) == 0 {
+			return nil, errors.New("no ssh host key fingerprint provided by the server")
+		}
+		return pinnedHostKey(r.SSHHostKey), nil
+	case hostKeyCheckKnownHosts:
+		if len(config().SSHKnownHostsFile) == 0 {
+			return nil, errors.New("no ssh known hosts file configured")
+		}
+		return knownHostKey(config().SSHKnownHostsFile, false), nil
+	case hostKeyCheckTOFU:
+		return knownHostKey(config().DataPath(tofuKnownHostsFileName), true), nil
+	case hostKeyCheckNone:
+		return ssh.InsecureIgnoreHostKey(), nil
+	default:
+		return nil, fmt.Errorf("unknown ssh host key check mode: %s", mode)
+	}
+}
+
+// pinnedHostKey accepts only the host key matching to the SHA256 (SHA256:xxx) or MD5 (xx:xx:...) fingerprint.
+func pinnedHostKey(fingerprint string) ssh.HostKeyCallback {
+	return func(hostname string, _ net.Addr, key ssh.PublicKey) error {
+		actual := ssh.FingerprintSHA256(key)
+		if !strings.HasPrefix(fingerprint, "SHA256:") {
+			fingerprint = strings.ToLower(strings.TrimPrefix(fingerprint, "MD5:"))
+			actual = ssh.FingerprintLegacyMD5(key)
+		}
+		if actual != fingerprint {
+			deferError("ssh host key mismatch for %s: expected %s, actual %s", hostname, fingerprint, actual)
+			return fmt.Errorf("ssh host key mismatch: %s", actual)
+		}
+		return nil
+	}
+}
+
+// knownHostKey verifies the host key using the known_hosts file.
+// Unknown hosts are added to the file if tofu (trust on first use) is true.
+func knownHostKey(path string, tofu bool) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if tofu {
+			f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0600)
+			if err != nil {
+				return fmt.Errorf("failed to open %s: %w", path, err)
+			}
+			safeClose(f, "known hosts")
+		}
+		callback, err := knownhosts.New(path)
+		if err != nil {
+			return fmt.Errorf("failed to load %s: %w", path, err)
+		}
+		err = callback(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+			if !tofu {
+				deferError("ssh host key of %s not found in %s: %s", hostname, path, ssh.FingerprintSHA256(key))
+				return err
+			}
+			return trustHostKey(path, hostname, key)
+		}
+		if err != nil {
+			deferError("ssh host key verification failed for %s: %v", hostname, err)
+			return err
+		}
+		return nil
+	}
+}
+
+// trustHostKey appends the host key to the known_hosts file.
+func trustHostKey(path string, hostname string, key ssh.PublicKey) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer safeClose(f, "known hosts")
+	if _, err := fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	log.Printf("ssh host key of %s trusted on first use: %s", hostname, ssh.FingerprintSHA256(key))
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	jobsSeenFileName = "jobs_seen.json"
+	jobsSeenCapacity = 1000 // Number of recent job IDs to remember
+)
+
+// job defines a command execution requested by the server.
+type job struct {
+	ID         string   `json:"id"`
+	Command    string   `json:"command"`
+	Args       []string `json:"args,omitempty"`
+	TimeoutSec int      `json:"timeout_sec,omitempty"`
+}
+
+// jobResult defines a result of the job execution.
+type jobResult struct {
+	ID        string `json:"id"`
+	ExitCode  int    `json:"exit_code"`           // -1 if the command could not be executed or timed out
+	Stdout    string `json:"stdout,omitempty"`    // Standard output (limited by job_max_output_kb)
+	Stderr    string `json:"stderr,omitempty"`    // Standard error (limited by job_max_output_kb)
+	Truncated bool   `json:"truncated,omitempty"` // Output exceeded the limit
+	Error     string `json:"error,omitempty"`     // Reason of the execution failure
+	StartTime int64  `json:"start_time"`          // Start time of the execution (UTC)
+	Millis    int64  `json:"ms"`                  // Execution time milliseconds
+}
+
+// limitedBuffer keeps output up to the limit and discards the rest.
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+var (
+	jobsSeen    = make(map[string]bool)
+	jobsSeenIDs []string // Job IDs in the order of acceptance, persisted to survive restarts
+	jobResults  []jobResult
+	jobsMutex   sync.Mutex
+	jobsRunning sync.Mutex
+)
+
+// handleJobs executes jobs not executed yet in the background.
+func handleJobs(jobs []job) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	var queue []job
+	for _, j := range jobs {
+		if len(j.ID) == 0 || jobsSeen[j.ID] {
+			continue
+		}
+		markJobSeen(j.ID)
+		queue = append(queue, j)
+	}
+	if len(queue) == 0 {
+		return
+	}
+	if err := saveJSON(config().DataPath(jobsSeenFileName), jobsSeenIDs); err != nil {
+		for _, j := range queue {
+			jobResults = append(jobResults, jobResult{
+				ID:        j.ID,
+				ExitCode:  -1,
+				Error:     fmt.Sprintf("failed to save job id: %v", err),
+				StartTime: time.Now().UTC().Unix(),
+			})
+		}
+		return
+	}
+	go func() {
+		jobsRunning.Lock() // execute one by one
+		defer jobsRunning.Unlock()
+		for _, j := range queue {
+			result := runJob(j)
+			jobsMutex.Lock()
+			jobResults = append(jobResults, result)
+			jobsMutex.Unlock()
+		}
+	}()
+}
+
+// loadJobsSeen restores IDs of accepted jobs from the data directory.
+func loadJobsSeen() {
+	var ids []string
+	if err := loadJSON(config().DataPath(jobsSeenFileName), &ids); err != nil {
+		log.Printf("failed to load accepted job ids: %v", err)
+		return
+	}
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	for _, id := range ids {
+		markJobSeen(id)
+	}
+}
+
+// markJobSeen records the job ID as accepted, forgetting the oldest one over the capacity.
+// It must be called while holding jobsMutex.
+func markJobSeen(id string) {
+	jobsSeen[id] = true
+	jobsSeenIDs = append(jobsSeenIDs, id)
+	if len(jobsSeenIDs) > jobsSeenCapacity {
+		delete(jobsSeen, jobsSeenIDs[0])
+		jobsSeenIDs = append([]string{}, jobsSeenIDs[1:]...)
+	}
+}
+
+// runJob executes the job if the command is allowed.
+func runJob(j job) jobResult {
+	result := jobResult{ID: j.ID, ExitCode: -1, StartTime: time.Now().UTC().Unix()}
+	if !config().JobsEnabled {
+		result.Error = "jobs disabled"
+		return result
+	}
+	if !jobAllowed(j.Command) {
+		result.Error = "command not allowed: " + j.Command
+		return result
+	}
+	timeout := config().JobMaxTimeoutSec
+	if j.TimeoutSec > 0 && j.TimeoutSec < timeout {
+		timeout = j.TimeoutSec
+	}
+	stdout := &limitedBuffer{limit: config().JobMaxOutputKB * 1024}
+	stderr := &limitedBuffer{limit: config().JobMaxOutputKB * 1024}
+	cmd := exec.Command(j.Command, j.Args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	prepareJob(cmd)
+	log.Printf("executing job %s: %s %v", j.ID, j.Command, j.Args)
+	begin := time.Now()
+	err := cmd.Start()
+	var timedOut atomic.Bool
+	if err == nil {
+		timer := time.AfterFunc(time.Duration(timeout)*time.Second, func() {
+			timedOut.Store(true)
+			if err := killJob(cmd); err != nil {
+				log.Printf("failed to kill job %s: %v", j.ID, err)
+			}
+		})
+		err = cmd.Wait()
+		timer.Stop()
+	}
+	result.Millis = time.Since(begin).Milliseconds()
+	result.Stdout = stdout.buf.String()
+	result.Stderr = stderr.buf.String()
+	result.Truncated = stdout.truncated || stderr.truncated
+	var exitErr *exec.ExitError
+	switch {
+	case timedOut.Load():
+		result.Error = fmt.Sprintf("timed out after %d sec", timeout)
+	case errors.As(err, &exitErr):
+		result.ExitCode = exitErr.ExitCode()
+	case err != nil:
+		result.Error = err.Error()
+	default:
+		result.ExitCode = 0
+	}
+	return result
+}
+
+// jobAllowed reports whether the command exactly matches to the allowlist.
+func jobAllowed(command string) bool {
+	for _, allowed := range config().JobAllowlist {
+		if command == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// takeJobResults returns and clears results of finished jobs.
+func takeJobResults() []jobResult {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	results := jobResults
+	jobResults = nil
+	return results
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if remain := b.limit - b.buf.Len(); remain < len(p) {
+		b.truncated = true
+		if remain > 0 {
+			b.buf.Write(p[:remain])
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
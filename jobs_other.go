@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// prepareJob does nothing on the platforms without process groups.
+func prepareJob(*exec.Cmd) {}
+
+// killJob kills the process of the job.
+func killJob(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
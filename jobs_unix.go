@@ -0,0 +1,18 @@
+//go:build unix
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// prepareJob starts the job in a new process group, so that child processes can be killed together.
+func prepareJob(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killJob kills the process group of the job. Otherwise a child holding stdout or stderr blocks the job forever.
+func killJob(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
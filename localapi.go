@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	logLinesCapacity        = 200
+	localAPIShutdownTimeout = 5 * time.Second
+	maskedSecret            = "********"
+)
+
+// agentStatus defines the latest activities of the agent served by the local API.
+type agentStatus struct {
+	ID                string       `json:"id"`
+	Adapter           string       `json:"adapter"`
+	CustomID          string       `json:"custom_id,omitempty"`
+	AgentVersion      string       `json:"agent_version"`
+	BootTime          int64        `json:"boot_time"`
+	LastReportTime    int64        `json:"last_report_time,omitempty"` // Generated time of the last report
+	LastUploadTime    int64        `json:"last_upload_time,omitempty"` // Time of the last upload attempt
+	LastUploadSuccess bool         `json:"last_upload_success"`
+	LastUploadError   string       `json:"last_upload_error,omitempty"`
+	SSH               sshStatus    `json:"ssh"`
+	Update            updateStatus `json:"update"`
+	Spooled           int          `json:"spooled"` // Number of spooled reports
+	Errors            []string     `json:"errors,omitempty"`
+	ConfigVersion     string       `json:"config_version,omitempty"`
+}
+
+// sshStatus defines the SSH tunnel state.
+type sshStatus struct {
+	Enabled     bool                   `json:"enabled"`
+	Connected   bool                   `json:"connected"`
+	State       string                 `json:"state"`
+	Server      string                 `json:"server,omitempty"`
+	ConnectTime int64                  `json:"connect_time,omitempty"`
+	RemotePorts map[string]int         `json:"remote_ports,omitempty"`
+	TunnelStats map[string]tunnelStats `json:"tunnel_stats,omitempty"`
+}
+
+// updateStatus defines the update checker state.
+type updateStatus struct {
+	Enabled       bool   `json:"enabled"`
+	Running       bool   `json:"running"`                   // Update checker is running
+	LastCheckTime int64  `json:"last_check_time,omitempty"` // Time of the last version check
+	LatestVersion string `json:"latest_version,omitempty"`  // Latest version of the last version check
+	FailedVersion string `json:"failed_version,omitempty"`  // Version rolled back from
+}
+
+// logLines keeps recent lines of the log output.
+type logLines struct {
+	mutex   sync.Mutex
+	lines   []string
+	partial []byte
+}
+
+var (
+	recentLogs     = &logLines{}
+	lastReport     *report
+	lastReply      *reply
+	lastUploadTime time.Time
+	lastUploadErr  error
+	lastCheckTime  time.Time
+	latestVersion  string
+	localAPIServer *http.Server
+	localAPIMutex  sync.Mutex
+	activityMutex  sync.Mutex
+)
+
+// startLocalAPI starts the local API server if not started.
+func startLocalAPI() {
+	localAPIMutex.Lock()
+	defer localAPIMutex.Unlock()
+	if localAPIServer != nil {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", handleLocalStatus)
+	mux.HandleFunc("/report", handleLocalReport)
+	mux.HandleFunc("/reply", handleLocalReply)
+	mux.HandleFunc("/logs", handleLocalLogs)
+	mux.HandleFunc("/metrics", handleLocalMetrics)
+	server := &http.Server{Addr: config().LocalAPIListen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	localAPIServer = server
+	go func() {
+		log.Printf("local api listening on %s", server.Addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			deferError("failed to start local api: %v", err)
+		}
+	}()
+}
+
+// stopLocalAPI stops the running local API server.
+func stopLocalAPI() {
+	localAPIMutex.Lock()
+	defer localAPIMutex.Unlock()
+	if localAPIServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), localAPIShutdownTimeout)
+	defer cancel()
+	if err := localAPIServer.Shutdown(ctx); err != nil {
+		log.Printf("failed to stop local api: %v", err)
+	}
+	localAPIServer = nil
+}
+
+func handleLocalStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	connectTime, _ := sshConnection()
+	d := device()
+	activityMutex.Lock()
+	status := agentStatus{
+		ID:                d.ID,
+		Adapter:           d.Adapter,
+		CustomID:          config().CustomID,
+		AgentVersion:      ver,
+		BootTime:          bootTime.Unix(),
+		LastUploadSuccess: !lastUploadTime.IsZero() && lastUploadErr == nil,
+		ConfigVersion:     config().Version,
+		SSH: sshStatus{
+			Enabled:     config().SSHEnabled,
+			Connected:   !connectTime.IsZero(),
+			State:       tunnelState(),
+			Server:      sshReply().SSHServerHost,
+			RemotePorts: remotePorts(),
+			TunnelStats: tunnelStatsSnapshot(),
+		},
+		Update: updateStatus{
+			Enabled:       config().UpdateEnabled,
+			LatestVersion: latestVersion,
+			FailedVersion: failedVersion(),
+		},
+	}
+	if lastReport != nil {
+		status.LastReportTime = lastReport.DeviceTime
+		status.Errors = lastReport.Errors
+	}
+	if !lastUploadTime.IsZero() {
+		status.LastUploadTime = lastUploadTime.Unix()
+	}
+	if lastUploadErr != nil {
+		status.LastUploadError = lastUploadErr.Error()
+	}
+	if !lastCheckTime.IsZero() {
+		status.Update.LastCheckTime = lastCheckTime.Unix()
+	}
+	activityMutex.Unlock()
+	if status.SSH.Connected {
+		status.SSH.ConnectTime = connectTime.Unix()
+	}
+	updateCheckerMutex.Lock()
+	status.Update.Running = updateCheckerStop != nil
+	updateCheckerMutex.Unlock()
+	if entries, err := spoolEntries(spoolDir()); err == nil {
+		status.Spooled = len(entries)
+	}
+	writeJSON(w, status)
+}
+
+func handleLocalReport(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		activityMutex.Lock()
+		rep := lastReport
+		activityMutex.Unlock()
+		if rep == nil {
+			http.Error(w, "no report generated yet", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, rep)
+	case http.MethodPost:
+		log.Print("report requested by local api")
+		go doReport(triggerLocalAPI)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleLocalReply(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	activityMutex.Lock()
+	rep := lastReply
+	activityMutex.Unlock()
+	if rep == nil {
+		http.Error(w, "no reply received yet", http.StatusNotFound)
+		return
+	}
+	masked := *rep
+	if len(masked.SSHKey) > 0 {
+		masked.SSHKey = maskedSecret
+	}
+	if len(masked.SSHPassword) > 0 {
+		masked.SSHPassword = maskedSecret
+	}
+	writeJSON(w, masked)
+}
+
+func handleLocalLogs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, recentLogs.snapshot())
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		log.Printf("failed to write local api response: %v", err)
+	}
+}
+
+// recordReport records the generated report.
+func recordReport(r report) {
+	activityMutex.Lock()
+	defer activityMutex.Unlock()
+	lastReport = &r
+}
+
+// recordUpload records the result of the upload.
+func recordUpload(err error) {
+	activityMutex.Lock()
+	defer activityMutex.Unlock()
+	lastUploadTime = time.Now().UTC()
+	lastUploadErr = err
+	reportsAttempted.Add(1)
+	if err != nil {
+		reportsFailed.Add(1)
+	} else {
+		reportsSucceeded.Add(1)
+	}
+}
+
+// recordReply records the reply of the server.
+func recordReply(r reply) {
+	activityMutex.Lock()
+	defer activityMutex.Unlock()
+	lastReply = &r
+}
+
+// recordUpdateCheck records the result of the version check.
+func recordUpdateCheck(latest string) {
+	activityMutex.Lock()
+	defer activityMutex.Unlock()
+	lastCheckTime = time.Now().UTC()
+	latestVersion = latest
+}
+
+// Write implements io.Writer to capture log lines.
+func (l *logLines) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	data := append(l.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		l.lines = append(l.lines, string(data[:i]))
+		data = data[i+1:]
+	}
+	l.partial = append([]byte{}, data...)
+	if len(l.lines) > logLinesCapacity {
+		l.lines = append([]string{}, l.lines[len(l.lines)-logLinesCapacity:]...)
+	}
+	return len(p), nil
+}
+
+// snapshot returns a copy of the recent log lines.
+func (l *logLines) snapshot() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]string{}, l.lines...)
+}
@@ -5,7 +5,10 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"os"
+	"os/exec"
 	"runtime"
+	"strings"
 	"sync"
 	"time"
 )
@@ -13,26 +16,24 @@ import (
 const (
 	defaultConfigFilePath = "kaginawa.json"
 	macDetectionRetrySec  = 15
+	configWatchGapSec     = 5
 )
 
 var (
 	ver            = "v0.0.0"
+	updateKeys     = "" // comma-separated trusted update keys embedded by the build
 	configPath     = flag.String("c", defaultConfigFilePath, "path to configuration file")
 	versionPrint   = flag.Bool("v", false, "print version and exit")
 	debugPrint     = flag.Bool("d", false, "log report content")
 	bootTime       time.Time
-	macAddr        string
-	adapterName    string
-	localIPv6      string
-	localIPv4      string
 	sshLoopStarted sync.Once
-	sshConnectTime time.Time
-	sshRemotePort  = 0
+	reportTicker   *time.Ticker
 )
 
 func main() {
 	bootTime = time.Now().UTC()
 	flag.Parse()
+	log.SetOutput(io.MultiWriter(os.Stderr, recentLogs))
 
 	// Print version
 	if *versionPrint {
@@ -44,6 +45,9 @@ func main() {
 	if err := loadConfig(*configPath); err != nil {
 		log.Fatal(err)
 	}
+	loadRebootID()
+	loadJobsSeen()
+	checkProbation()
 
 	// Determine the ID
 	for {
@@ -55,17 +59,29 @@ func main() {
 		}
 		break
 	}
-	log.Printf("Kaginawa %s on %s", ver, macAddr)
+	log.Printf("Kaginawa %s on %s", ver, device().ID)
 
 	// Update checker
-	if config.UpdateEnabled {
-		go updateChecker()
+	if config().UpdateEnabled {
+		startUpdateChecker()
 	}
 
 	// Main loop
-	doReport(0)
-	for range time.Tick(time.Duration(config.ReportIntervalMin) * time.Minute) {
-		doReport(config.ReportIntervalMin)
+	reportTicker = time.NewTicker(time.Duration(config().ReportIntervalMin) * time.Minute)
+	go watchConfig()
+	go watchEvents()
+	if config().LocalAPIEnabled {
+		startLocalAPI()
+	}
+	if len(config().MetricsListen) > 0 {
+		startMetricsServer()
+	}
+	if config().ControlEnabled {
+		startControl()
+	}
+	doReport(triggerBoot)
+	for range reportTicker.C {
+		doReport(config().ReportIntervalMin)
 	}
 }
 
@@ -74,3 +90,14 @@ func safeClose(closer io.Closer, name string) {
 		log.Printf("failed to close %s: %v", name, err)
 	}
 }
+
+// runCommand executes the space-separated command line and logs the result.
+func runCommand(command string) {
+	split := strings.Split(command, " ")
+	res, err := exec.Command(split[0], split[1:]...).Output()
+	if err != nil {
+		log.Printf("%s: %v", command, err)
+	} else {
+		log.Printf("%s: %s", command, res)
+	}
+}
@@ -11,7 +11,7 @@ import (
 
 func measureRoundTripTimeMills() (int64, error) {
 	begin := time.Now()
-	resp, err := http.Get("http://" + config.Server + "/measure/0") // Use http to reduce overhead
+	resp, err := http.Get("http://" + config().Server + "/measure/0") // Use http to reduce overhead
 	if err != nil {
 		return -1, err
 	}
@@ -28,7 +28,7 @@ func measureRoundTripTimeMills() (int64, error) {
 
 func measureThroughput(kb int) (int64, int64, error) {
 	downloadBegin := time.Now()
-	dr, err := http.Get("http://" + config.Server + "/measure/" + strconv.Itoa(kb)) // Use http to reduce overhead
+	dr, err := http.Get("http://" + config().Server + "/measure/" + strconv.Itoa(kb)) // Use http to reduce overhead
 	if err != nil {
 		return -1, -1, err
 	}
@@ -42,7 +42,7 @@ func measureThroughput(kb int) (int64, int64, error) {
 	}
 	body := bytes.NewBuffer(make([]byte, kb*1024))
 	uploadBegin := time.Now()
-	ur, err := http.Post("http://"+config.Server+"/measure/"+strconv.Itoa(kb), "application/octet-stream", body)
+	ur, err := http.Post("http://"+config().Server+"/measure/"+strconv.Itoa(kb), "application/octet-stream", body)
 	if err != nil {
 		return -1, -1, err
 	}
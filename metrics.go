@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const metricsPrefix = "kaginawa_"
+
+// Agent counters exposed by the metrics endpoint.
+var (
+	reportsAttempted atomic.Int64
+	reportsSucceeded atomic.Int64
+	reportsFailed    atomic.Int64
+	sshConnections   atomic.Int64
+	updateAttempts   atomic.Int64
+)
+
+var (
+	metricsServer *http.Server
+	metricsMutex  sync.Mutex
+)
+
+// startMetricsServer starts the metrics-only server if not started.
+// It serves /metrics without other endpoints of the local API, so that it can be exposed to the network for scraping.
+func startMetricsServer() {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	if metricsServer != nil {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleLocalMetrics)
+	server := &http.Server{Addr: config().MetricsListen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	metricsServer = server
+	go func() {
+		log.Printf("metrics listening on %s", server.Addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			deferError("failed to start metrics server: %v", err)
+		}
+	}()
+}
+
+// stopMetricsServer stops the running metrics-only server.
+func stopMetricsServer() {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	if metricsServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), localAPIShutdownTimeout)
+	defer cancel()
+	if err := metricsServer.Shutdown(ctx); err != nil {
+		log.Printf("failed to stop metrics server: %v", err)
+	}
+	metricsServer = nil
+}
+
+// handleLocalMetrics writes numeric fields of the last report and agent counters in the Prometheus text format.
+func handleLocalMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	labels := fmt.Sprintf(`id="%s",custom_id="%s"`, escapeLabel(device().ID), escapeLabel(config().CustomID))
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	// Report fields
+	activityMutex.Lock()
+	rep := lastReport
+	var lastUpload, lastSuccess int64
+	if !lastUploadTime.IsZero() {
+		lastUpload = lastUploadTime.Unix()
+		if lastUploadErr == nil {
+			lastSuccess = lastUpload
+		}
+	}
+	activityMutex.Unlock()
+	if rep != nil {
+		v := reflect.ValueOf(*rep)
+		for i := 0; i < v.NumField(); i++ {
+			name := jsonName(v.Type().Field(i))
+			value, ok := numericValue(v.Field(i))
+			if !ok || len(name) == 0 {
+				continue
+			}
+			writeMetric(w, "gauge", name, "Report field "+name, labels, value)
+		}
+		writeListMetrics(w, "disks", labels, reflect.ValueOf(rep.Disks), [][2]string{{"mount_point", "mount_point"}})
+		writeListMetrics(w, "sensors", labels, reflect.ValueOf(rep.Sensors), [][2]string{{"name", "name"}, {"label", "label"}, {"unit", "unit"}})
+		writeListMetrics(w, "network_interfaces", labels, reflect.ValueOf(rep.Interfaces), [][2]string{{"interface", "name"}})
+		if rep.Throttling != nil {
+			writeListMetrics(w, "throttling", labels, reflect.ValueOf([]throttling{*rep.Throttling}), nil)
+		}
+	}
+
+	// Agent counters
+	writeMetric(w, "counter", "reports_attempted_total", "Number of attempted report uploads", labels, float64(reportsAttempted.Load()))
+	writeMetric(w, "counter", "reports_succeeded_total", "Number of succeeded report uploads", labels, float64(reportsSucceeded.Load()))
+	writeMetric(w, "counter", "reports_failed_total", "Number of failed report uploads", labels, float64(reportsFailed.Load()))
+	writeMetric(w, "gauge", "last_upload_timestamp_seconds", "Time of the last upload attempt", labels, float64(lastUpload))
+	writeMetric(w, "gauge", "last_upload_success_timestamp_seconds", "Time of the last succeeded upload", labels, float64(lastSuccess))
+	writeMetric(w, "counter", "ssh_reconnects_total", "Number of SSH connections established after the first one", labels, float64(sshReconnects()))
+	writeMetric(w, "counter", "update_attempts_total", "Number of update attempts", labels, float64(updateAttempts.Load()))
+
+	// Tunnel traffic by forward names
+	stats := tunnelStatsSnapshot()
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, metric := range []struct {
+		name, help string
+		value      func(s tunnelStats) int64
+	}{
+		{"ssh_tunnel_bytes_in_total", "Transferred bytes from remote to local", func(s tunnelStats) int64 { return s.BytesIn }},
+		{"ssh_tunnel_bytes_out_total", "Transferred bytes from local to remote", func(s tunnelStats) int64 { return s.BytesOut }},
+		{"ssh_tunnel_connections_total", "Number of accepted tunnel connections", func(s tunnelStats) int64 { return int64(s.TotalConns) }},
+	} {
+		if len(names) == 0 {
+			break
+		}
+		fmt.Fprintf(w, "# HELP %s%s %s\n# TYPE %s%s counter\n", metricsPrefix, metric.name, metric.help, metricsPrefix, metric.name)
+		for _, name := range names {
+			fmt.Fprintf(w, "%s%s{%s,forward=\"%s\"} %d\n", metricsPrefix, metric.name, labels, escapeLabel(name), metric.value(stats[name]))
+		}
+	}
+}
+
+// sshReconnects returns the number of SSH connections established after the first one.
+func sshReconnects() int64 {
+	if n := sshConnections.Load(); n > 1 {
+		return n - 1
+	}
+	return 0
+}
+
+// writeMetric writes a single metric with HELP and TYPE lines.
+func writeMetric(w io.Writer, kind, name, help, labels string, value float64) {
+	fmt.Fprintf(w, "# HELP %s%s %s\n# TYPE %s%s %s\n%s%s{%s} %v\n",
+		metricsPrefix, name, help, metricsPrefix, name, kind, metricsPrefix, name, labels, value)
+}
+
+// writeListMetrics writes numeric fields of the struct elements as gauges named with the prefix.
+// Each element is distinguished by labels taken from the string fields, given as pairs of label name and JSON name.
+func writeListMetrics(w io.Writer, prefix, labels string, list reflect.Value, labelFields [][2]string) {
+	if list.Len() == 0 {
+		return
+	}
+	t := list.Type().Elem()
+	elementLabels := make([]string, list.Len())
+	for i := range elementLabels {
+		elementLabels[i] = labels
+		for _, pair := range labelFields {
+			for j := 0; j < t.NumField(); j++ {
+				if jsonName(t.Field(j)) == pair[1] {
+					elementLabels[i] += fmt.Sprintf(`,%s="%s"`, pair[0], escapeLabel(list.Index(i).Field(j).String()))
+				}
+			}
+		}
+	}
+	for j := 0; j < t.NumField(); j++ {
+		name := jsonName(t.Field(j))
+		if _, ok := numericValue(list.Index(0).Field(j)); !ok || len(name) == 0 {
+			continue
+		}
+		name = prefix + "_" + name
+		fmt.Fprintf(w, "# HELP %s%s Report field %s\n# TYPE %s%s gauge\n", metricsPrefix, name, name, metricsPrefix, name)
+		for i := 0; i < list.Len(); i++ {
+			value, _ := numericValue(list.Index(i).Field(j))
+			fmt.Fprintf(w, "%s%s{%s} %v\n", metricsPrefix, name, elementLabels[i], value)
+		}
+	}
+}
+
+// jsonName returns the JSON name of the struct field, or empty string if not marshaled.
+func jsonName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if name == "-" {
+		return ""
+	}
+	return name
+}
+
+// numericValue converts numeric and boolean values into float64.
+func numericValue(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	case reflect.Bool:
+		if v.Bool() {
+			return 1, true
+		}
+		return 0, true
+	default:
+		return 0, false
+	}
+}
+
+// escapeLabel escapes a label value of the Prometheus text format.
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	transportHTTP      = "http"
+	transportMQTT      = "mqtt"
+	mqttTimeoutSec     = 30
+	mqttKeepAliveSec   = 60
+	mqttTopicIDPattern = "{id}"
+)
+
+var (
+	mqttClient mqtt.Client
+	mqttMutex  sync.Mutex
+)
+
+// uploadMQTT publishes the gzipped report to the report topic of the MQTT broker.
+// Replies of the server are received asynchronously from the reply topic.
+func uploadMQTT(report []byte) error {
+	client, err := connectMQTT()
+	if err != nil {
+		return err
+	}
+	gz := new(bytes.Buffer)
+	w := gzip.NewWriter(gz)
+	if _, err := w.Write(report); err != nil {
+		return fmt.Errorf("failed to gzip report: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to close gzipped report: %v", err)
+	}
+	token := client.Publish(mqttTopic(config().MQTTReportTopic), byte(config().MQTTQoS), false, gz.Bytes())
+	if !token.WaitTimeout(mqttTimeoutSec * time.Second) {
+		return errors.New("failed to publish report: timeout")
+	}
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("failed to publish report: %w", err)
+	}
+	return nil
+}
+
+// connectMQTT returns the connected MQTT client, connecting to the broker if not connected.
+func connectMQTT() (mqtt.Client, error) {
+	mqttMutex.Lock()
+	defer mqttMutex.Unlock()
+	if mqttClient != nil && mqttClient.IsConnectionOpen() {
+		return mqttClient, nil
+	}
+	if len(config().MQTTBroker) == 0 {
+		return nil, errors.New("no mqtt broker configured")
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(config().MQTTBroker).
+		SetClientID("kaginawa-" + strings.ReplaceAll(device().ID, ":", "")).
+		SetUsername(config().MQTTUsername).
+		SetPassword(config().MQTTPassword).
+		SetKeepAlive(mqttKeepAliveSec * time.Second).
+		SetConnectTimeout(mqttTimeoutSec * time.Second).
+		SetAutoReconnect(true).
+		SetOnConnectHandler(subscribeMQTT).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("mqtt connection lost: %v", err)
+		})
+	if len(config().MQTTCAFile) > 0 {
+		pem, err := os.ReadFile(config().MQTTCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read mqtt ca file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", config().MQTTCAFile)
+		}
+		opts.SetTLSConfig(&tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12})
+	}
+	if mqttClient != nil {
+		mqttClient.Disconnect(0)
+	}
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(mqttTimeoutSec * time.Second) {
+		client.Disconnect(0)
+		return nil, fmt.Errorf("failed to connect mqtt broker %s: timeout", config().MQTTBroker)
+	}
+	if err := token.Error(); err != nil {
+		return nil, fmt.Errorf("failed to connect mqtt broker %s: %w", config().MQTTBroker, err)
+	}
+	mqttClient = client
+	return client, nil
+}
+
+// subscribeMQTT subscribes the reply topic on every (re)connection.
+func subscribeMQTT(client mqtt.Client) {
+	topic := mqttTopic(config().MQTTReplyTopic)
+	token := client.Subscribe(topic, byte(config().MQTTQoS), func(_ mqtt.Client, m mqtt.Message) {
+		r, err := decodeMQTTReply(m.Payload())
+		if err != nil {
+			deferError("failed to decode mqtt reply: %v", err)
+			return
+		}
+		go handleReply(r)
+	})
+	if token.WaitTimeout(mqttTimeoutSec*time.Second) && token.Error() == nil {
+		log.Printf("mqtt subscribed: %s", topic)
+		return
+	}
+	deferError("failed to subscribe mqtt topic %s: %v", topic, token.Error())
+}
+
+// disconnectMQTT disconnects from the MQTT broker to reconnect with the latest configuration.
+func disconnectMQTT() {
+	mqttMutex.Lock()
+	defer mqttMutex.Unlock()
+	if mqttClient != nil {
+		mqttClient.Disconnect(250)
+		mqttClient = nil
+	}
+}
+
+// decodeMQTTReply decodes the reply message, which may be gzipped.
+func decodeMQTTReply(payload []byte) (reply, error) {
+	var r reply
+	if bytes.HasPrefix(payload, []byte{0x1f, 0x8b}) {
+		gr, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return r, fmt.Errorf("failed to read gzipped reply: %w", err)
+		}
+		if payload, err = io.ReadAll(gr); err != nil {
+			return r, fmt.Errorf("failed to read gzipped reply: %w", err)
+		}
+	}
+	if err := json.Unmarshal(payload, &r); err != nil {
+		return r, fmt.Errorf("failed to unmarshal reply: %w", err)
+	}
+	return r, nil
+}
+
+// mqttTopic replaces the {id} placeholder of the topic with the device ID.
+func mqttTopic(topic string) string {
+	return strings.ReplaceAll(topic, mqttTopicIDPattern, device().ID)
+}
+
+// mqttConfigChanged reports whether the MQTT connection needs to be reestablished.
+func mqttConfigChanged(old, c *Config) bool {
+	return old.Transport != c.Transport ||
+		old.MQTTBroker != c.MQTTBroker ||
+		old.MQTTUsername != c.MQTTUsername ||
+		old.MQTTPassword != c.MQTTPassword ||
+		old.MQTTCAFile != c.MQTTCAFile ||
+		old.MQTTReplyTopic != c.MQTTReplyTopic ||
+		old.MQTTQoS != c.MQTTQoS
+}
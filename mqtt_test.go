@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// MQTT 3.1.1 control packet types used by the test broker.
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttSubscribe  = 8
+	mqttSuback     = 9
+	mqttPingreq    = 12
+	mqttPingresp   = 13
+	mqttDisconnect = 14
+)
+
+// mqttMessage defines a message published to the test broker.
+type mqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+// testBroker is a minimal in-process MQTT 3.1.1 broker.
+// It accepts QoS 0 and 1 publications, and delivers messages to subscribers with QoS 0.
+type testBroker struct {
+	listener  net.Listener
+	mutex     sync.Mutex
+	subs      map[net.Conn][]string
+	published chan mqttMessage
+}
+
+func startTestBroker(t *testing.T) *testBroker {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBroker{listener: l, subs: map[net.Conn][]string{}, published: make(chan mqttMessage, 16)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { _ = l.Close() })
+	return b
+}
+
+func (b *testBroker) url() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+func (b *testBroker) serve(conn net.Conn) {
+	defer func() {
+		b.mutex.Lock()
+		delete(b.subs, conn)
+		b.mutex.Unlock()
+		_ = conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	for {
+		header, body, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		switch header >> 4 {
+		case mqttConnect:
+			b.write(conn, mqttConnack<<4, []byte{0, 0})
+		case mqttPublish:
+			topic, rest := readMQTTString(body)
+			if qos := (header >> 1) & 3; qos > 0 {
+				b.write(conn, mqttPuback<<4, rest[:2])
+				rest = rest[2:]
+			}
+			b.published <- mqttMessage{topic: topic, payload: rest}
+		case mqttSubscribe:
+			id, rest := body[:2], body[2:]
+			granted := []byte{}
+			for len(rest) > 0 {
+				var topic string
+				topic, rest = readMQTTString(rest)
+				rest = rest[1:] // requested QoS
+				granted = append(granted, 0)
+				b.mutex.Lock()
+				b.subs[conn] = append(b.subs[conn], topic)
+				b.mutex.Unlock()
+			}
+			b.write(conn, mqttSuback<<4, append(append([]byte{}, id...), granted...))
+		case mqttPingreq:
+			b.write(conn, mqttPingresp<<4, nil)
+		case mqttDisconnect:
+			return
+		}
+	}
+}
+
+// publish delivers the message to all subscribers of the topic.
+func (b *testBroker) publish(topic string, payload []byte) int {
+	body := append(mqttString(topic), payload...)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delivered := 0
+	for conn, topics := range b.subs {
+		for _, t := range topics {
+			if t == topic {
+				b.writeLocked(conn, mqttPublish<<4, body)
+				delivered++
+			}
+		}
+	}
+	return delivered
+}
+
+// subscribed waits until a client subscribes the topic.
+func (b *testBroker) subscribed(topic string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		b.mutex.Lock()
+		for _, topics := range b.subs {
+			for _, t := range topics {
+				if t == topic {
+					b.mutex.Unlock()
+					return true
+				}
+			}
+		}
+		b.mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func (b *testBroker) write(conn net.Conn, header byte, body []byte) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.writeLocked(conn, header, body)
+}
+
+func (b *testBroker) writeLocked(conn net.Conn, header byte, body []byte) {
+	packet := []byte{header}
+	n := len(body)
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if n == 0 {
+			break
+		}
+	}
+	_, _ = conn.Write(append(packet, body...))
+}
+
+// readPacket reads a control packet and returns the first byte of the fixed header and the rest.
+func readPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		if digit&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+		if multiplier > 128*128*128 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+func readMQTTString(b []byte) (string, []byte) {
+	n := binary.BigEndian.Uint16(b)
+	return string(b[2 : 2+n]), b[2+n:]
+}
+
+func mqttString(s string) []byte {
+	b := make([]byte, 2, 2+len(s))
+	binary.BigEndian.PutUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeMQTTReply(t *testing.T) {
+	plain := []byte(`{"ssh_host":"bastion.example.com","ssh_port":2222}`)
+	want := reply{SSHServerHost: "bastion.example.com", SSHServerPort: 2222}
+	tests := []struct {
+		name    string
+		payload []byte
+		want    reply
+		wantErr bool
+	}{
+		{name: "plain", payload: plain, want: want},
+		{name: "gzipped", payload: gzipBytes(t, plain), want: want},
+		{name: "invalid json", payload: []byte(`{`), wantErr: true},
+		{name: "broken gzip", payload: []byte{0x1f, 0x8b, 0x00}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeMQTTReply(tt.payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeMQTTReply() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeMQTTReply() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMQTTReportAndReply(t *testing.T) {
+	broker := startTestBroker(t)
+	c := defaultConfig.clone()
+	c.Transport = transportMQTT
+	c.MQTTBroker = broker.url()
+	c.SSHEnabled = false
+	activeConfig.Store(&c)
+	prev := currentDevice.Swap(&localDevice{ID: "02:00:00:00:00:01"})
+	t.Cleanup(func() {
+		disconnectMQTT()
+		activeConfig.Store(nil)
+		currentDevice.Store(prev)
+	})
+
+	// Report
+	data := []byte(`{"id":"02:00:00:00:00:01","trigger":0}`)
+	if err := uploadMQTT(data); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-broker.published:
+		if m.topic != "kaginawa/02:00:00:00:00:01/report" {
+			t.Errorf("report topic = %s", m.topic)
+		}
+		gr, err := gzip.NewReader(bytes.NewReader(m.payload))
+		if err != nil {
+			t.Fatalf("report is not gzipped: %v", err)
+		}
+		raw, err := io.ReadAll(gr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(raw, data) {
+			t.Errorf("report = %s, want %s", raw, data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no report published")
+	}
+
+	// Reply
+	topic := "kaginawa/02:00:00:00:00:01/reply"
+	if !broker.subscribed(topic, 5*time.Second) {
+		t.Fatalf("reply topic not subscribed: %s", topic)
+	}
+	want := reply{SSHServerHost: "bastion.example.com", SSHServerPort: 2222}
+	payload := gzipBytes(t, []byte(`{"ssh_host":"bastion.example.com","ssh_port":2222}`))
+	if n := broker.publish(topic, payload); n != 1 {
+		t.Fatalf("reply delivered to %d subscribers", n)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		activityMutex.Lock()
+		got := lastReply
+		activityMutex.Unlock()
+		if got != nil {
+			if !reflect.DeepEqual(*got, want) {
+				t.Errorf("handled reply = %+v, want %+v", *got, want)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("reply not handled")
+}
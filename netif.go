@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// networkInterface defines attributes, addresses and traffic counters of a network interface.
+type networkInterface struct {
+	Name           string   `json:"name"`
+	MAC            string   `json:"mac,omitempty"`
+	Flags          []string `json:"flags,omitempty"`            // ex. up, broadcast, multicast
+	MTU            int      `json:"mtu"`                        // Maximum transmission unit
+	Addresses      []string `json:"addresses,omitempty"`        // All addresses with prefix lengths
+	RxBytes        int64    `json:"rx_bytes,omitempty"`         // Received bytes
+	RxPackets      int64    `json:"rx_packets,omitempty"`       // Received packets
+	RxErrors       int64    `json:"rx_errors,omitempty"`        // Receive errors
+	RxDrops        int64    `json:"rx_drops,omitempty"`         // Dropped received packets
+	TxBytes        int64    `json:"tx_bytes,omitempty"`         // Transmitted bytes
+	TxPackets      int64    `json:"tx_packets,omitempty"`       // Transmitted packets
+	TxErrors       int64    `json:"tx_errors,omitempty"`        // Transmit errors
+	TxDrops        int64    `json:"tx_drops,omitempty"`         // Dropped transmitted packets
+	RxBytesDelta   int64    `json:"rx_bytes_delta,omitempty"`   // Received bytes since the last report
+	RxPacketsDelta int64    `json:"rx_packets_delta,omitempty"` // Received packets since the last report
+	TxBytesDelta   int64    `json:"tx_bytes_delta,omitempty"`   // Transmitted bytes since the last report
+	TxPacketsDelta int64    `json:"tx_packets_delta,omitempty"` // Transmitted packets since the last report
+}
+
+// netDevCounters defines traffic counters of /proc/net/dev.
+type netDevCounters struct {
+	rxBytes, rxPackets, rxErrors, rxDrops int64
+	txBytes, txPackets, txErrors, txDrops int64
+}
+
+var lastNetDevCounters map[string]netDevCounters
+
+// networkInterfaces lists all network interfaces with traffic counters (Linux only).
+func networkInterfaces(root string) ([]networkInterface, error) {
+	adapters, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect network interface: %w", err)
+	}
+	var counters map[string]netDevCounters
+	if runtime.GOOS == "linux" {
+		if counters, err = netDevStats(root); err != nil {
+			return nil, fmt.Errorf("failed to read traffic counters: %w", err)
+		}
+	}
+	list := make([]networkInterface, 0, len(adapters))
+	for _, adapter := range adapters {
+		ni := networkInterface{
+			Name: adapter.Name,
+			MAC:  strings.ToLower(adapter.HardwareAddr.String()),
+			MTU:  adapter.MTU,
+		}
+		if adapter.Flags != 0 {
+			ni.Flags = strings.Split(adapter.Flags.String(), "|")
+		}
+		if addresses, err := adapter.Addrs(); err == nil {
+			for _, address := range addresses {
+				ni.Addresses = append(ni.Addresses, address.String())
+			}
+		}
+		if c, ok := counters[adapter.Name]; ok {
+			ni.RxBytes, ni.RxPackets, ni.RxErrors, ni.RxDrops = c.rxBytes, c.rxPackets, c.rxErrors, c.rxDrops
+			ni.TxBytes, ni.TxPackets, ni.TxErrors, ni.TxDrops = c.txBytes, c.txPackets, c.txErrors, c.txDrops
+			if prev, ok := lastNetDevCounters[adapter.Name]; ok {
+				ni.RxBytesDelta = counterDelta(prev.rxBytes, c.rxBytes)
+				ni.RxPacketsDelta = counterDelta(prev.rxPackets, c.rxPackets)
+				ni.TxBytesDelta = counterDelta(prev.txBytes, c.txBytes)
+				ni.TxPacketsDelta = counterDelta(prev.txPackets, c.txPackets)
+			}
+		}
+		list = append(list, ni)
+	}
+	if counters != nil {
+		lastNetDevCounters = counters
+	}
+	return list, nil
+}
+
+// netDevStats reads traffic counters of all interfaces from net/dev file of the proc filesystem.
+func netDevStats(root string) (map[string]netDevCounters, error) {
+	raw, err := os.ReadFile(filepath.Join(root, "net", "dev"))
+	if err != nil {
+		return nil, err
+	}
+	counters := make(map[string]netDevCounters)
+	for _, line := range strings.Split(string(raw), "\n") {
+		name, values, found := strings.Cut(line, ":")
+		if !found {
+			continue // headers
+		}
+		fields := strings.Fields(values)
+		if len(fields) < 12 {
+			continue
+		}
+		v := make([]int64, 12)
+		for i := range v {
+			v[i], _ = strconv.ParseInt(fields[i], 10, 64)
+		}
+		counters[strings.TrimSpace(name)] = netDevCounters{
+			rxBytes: v[0], rxPackets: v[1], rxErrors: v[2], rxDrops: v[3],
+			txBytes: v[8], txPackets: v[9], txErrors: v[10], txDrops: v[11],
+		}
+	}
+	return counters, nil
+}
+
+// counterDelta returns increase of the counter, treating a decrease as a counter reset.
+func counterDelta(prev, current int64) int64 {
+	if current < prev {
+		return current
+	}
+	return current - prev
+}
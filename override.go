@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+)
+
+const configOverrideFileName = "config_override.json"
+
+// Parameters not overridable by the remote configuration.
+var localOnlyConfigKeys = []string{
+	"api_key",
+	"server",
+	"data_dir",
+	"remote_config_enabled",
+	"job_allowlist",
+	"update_check_url",
+	"update_command",
+	"update_public_keys",
+	"reboot_command",
+	"ssh_host_key_check",
+	"ssh_known_hosts_file",
+	"spool_dir",
+	"local_api_enabled",
+	"local_api_listen",
+	"metrics_listen",
+	"transport",
+	"mqtt_broker",
+	"mqtt_username",
+	"mqtt_password",
+	"mqtt_ca_file",
+}
+
+// configOverride defines a partial configuration pushed by the server.
+type configOverride struct {
+	Version string          `json:"version"`
+	Config  json.RawMessage `json:"config"`
+}
+
+// loadConfigOverride loads the saved remote configuration. It returns nil if not saved.
+func loadConfigOverride(c *Config) (*configOverride, error) {
+	var o *configOverride
+	if err := loadJSON(c.DataPath(configOverrideFileName), &o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// apply returns the configuration overridden by parameters except local-only ones.
+func (o configOverride) apply(c *Config) (*Config, error) {
+	var params map[string]json.RawMessage
+	if err := json.Unmarshal(o.Config, &params); err != nil {
+		return nil, err
+	}
+	for _, key := range localOnlyConfigKeys {
+		delete(params, key)
+	}
+	data, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	rc := c.clone()
+	if err := json.Unmarshal(data, &rc); err != nil {
+		return nil, err
+	}
+	if err := rc.validate(); err != nil {
+		return nil, err
+	}
+	rc.Version = o.Version
+	return &rc, nil
+}
+
+// handleConfigOverride applies the remote configuration on top of the local configuration file, and saves it.
+func handleConfigOverride(version string, raw json.RawMessage) {
+	if !config().RemoteConfigEnabled {
+		return
+	}
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	compacted := new(bytes.Buffer)
+	if err := json.Compact(compacted, raw); err != nil {
+		deferError("remote configuration %s rejected: %v", version, err)
+		return
+	}
+	o := configOverride{Version: version, Config: compacted.Bytes()}
+	if current, err := loadConfigOverride(config()); err == nil && current != nil &&
+		current.Version == o.Version && bytes.Equal(current.Config, o.Config) {
+		return // already applied
+	}
+	local, err := readLocalConfig(*configPath)
+	if err != nil {
+		log.Printf("failed to read local configuration: %v", err)
+		return
+	}
+	if !local.RemoteConfigEnabled {
+		return
+	}
+	c, err := o.apply(local)
+	if err != nil {
+		deferError("remote configuration %s rejected: %v", version, err)
+		return
+	}
+	if err := saveJSON(c.DataPath(configOverrideFileName), o); err != nil {
+		deferError("failed to save remote configuration %s: %v", version, err)
+		return
+	}
+	log.Printf("remote configuration %s applied", version)
+	applyConfig(c)
+}
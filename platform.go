@@ -8,19 +8,27 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
-	"strconv"
+	"sort"
 	"strings"
+	"sync/atomic"
 )
 
+const identityFileName = "device_id.json"
+
 type diskUsageReport struct {
-	TotalBytes int64
-	UsedBytes  int64
-	Label      string
-	Filesystem string
-	MountPoint string
-	Device     string
+	TotalBytes  int64  `json:"total_bytes"`            // Total disk space (Bytes)
+	UsedBytes   int64  `json:"used_bytes"`             // Used disk space (Bytes)
+	Label       string `json:"label,omitempty"`        // Disk label
+	Filesystem  string `json:"filesystem,omitempty"`   // Filesystem name
+	MountPoint  string `json:"mount_point"`            // Mount point
+	Device      string `json:"device,omitempty"`       // Device name
+	InodesTotal int64  `json:"inodes_total,omitempty"` // Total inodes
+	InodesUsed  int64  `json:"inodes_used,omitempty"`  // Used inodes
+	ReadOnly    bool   `json:"read_only"`              // Mounted read-only
 }
 
 type darwinSystemProfile struct {
@@ -52,20 +60,100 @@ type darwinBluetoothDataType struct {
 	} `json:"local_device_title"`
 }
 
+// identity defines the selected device ID and its source network interface.
+type identity struct {
+	ID      string `json:"id"`
+	Adapter string `json:"adapter"`
+}
+
+// localDevice defines the device ID and addresses of the selected network interface.
+type localDevice struct {
+	ID      string
+	Adapter string
+	IPv4    string
+	IPv6    string
+}
+
+var (
+	savedIdentity *identity
+	idChangedFrom string // Previous ID if the ID has been changed since the last report
+	currentDevice atomic.Pointer[localDevice]
+)
+
+// device returns the device ID and addresses selected by the last initID call.
+func device() localDevice {
+	if d := currentDevice.Load(); d != nil {
+		return *d
+	}
+	return localDevice{}
+}
+
+// initID selects the network interface as the source of the device ID.
+// The saved interface is kept while it exists, otherwise an interface is selected by the configured rules;
+// preferred interface name (glob), excluded names and physical interfaces, in alphabetical order.
 func initID() error {
 	adapters, err := net.Interfaces()
 	if err != nil {
 		return fmt.Errorf("failed to collect network interface: %w", err)
 	}
-	for _, adapter := range adapters {
-		if adapter.HardwareAddr == nil || !strings.Contains(adapter.Flags.String(), "up") {
-			continue // ignore odd or down adapters
+	if savedIdentity == nil {
+		if err := loadJSON(config().DataPath(identityFileName), &savedIdentity); err != nil {
+			log.Printf("failed to load device id: %v", err)
+		}
+	}
+	if savedIdentity == nil && len(config().IDInterface) == 0 {
+		// Keep the ID selected by the previous versions on upgrade
+		if savedIdentity = legacyIdentity(adapters); savedIdentity != nil {
+			if err := saveJSON(config().DataPath(identityFileName), savedIdentity); err != nil {
+				log.Printf("failed to save device id: %v", err)
+			}
 		}
-		addresses, err := adapter.Addrs()
-		if err != nil || len(addresses) == 0 {
-			continue // ignore unassigned adapters
+	}
+	sort.Slice(adapters, func(i, j int) bool { return adapters[i].Name < adapters[j].Name })
+
+	// Keep the saved interface while it exists
+	var selected *net.Interface
+	if savedIdentity != nil && (len(config().IDInterface) == 0 || matchName(config().IDInterface, savedIdentity.Adapter)) {
+		for i, adapter := range adapters {
+			if adapter.Name == savedIdentity.Adapter && strings.ToLower(adapter.HardwareAddr.String()) == savedIdentity.ID {
+				selected = &adapters[i]
+				break
+			}
+		}
+	}
+
+	// Select by rules
+	if selected == nil {
+		bestRank := -1
+		for i, adapter := range adapters {
+			if adapter.HardwareAddr == nil || !strings.Contains(adapter.Flags.String(), "up") {
+				continue // ignore odd or down adapters
+			}
+			addresses, err := adapter.Addrs()
+			if err != nil || len(addresses) == 0 {
+				continue // ignore unassigned adapters
+			}
+			rank := 0
+			if len(config().IDInterface) > 0 && matchName(config().IDInterface, adapter.Name) {
+				rank += 4
+			} else if excludedAdapter(adapter.Name) {
+				continue
+			}
+			if config().IDPreferPhysical && physicalAdapter(adapter.Name) {
+				rank += 2
+			}
+			if rank > bestRank {
+				selected = &adapters[i]
+				bestRank = rank
+			}
 		}
-		var v4, v6 string
+	}
+	if selected == nil {
+		return errors.New("no adapter available")
+	}
+
+	var v4, v6 string
+	if addresses, err := selected.Addrs(); err == nil {
 		for _, address := range addresses {
 			if len(v6) == 0 && strings.Contains(address.String(), ":") {
 				v6 = trimSubnetMusk(address)
@@ -74,77 +162,167 @@ func initID() error {
 				v4 = trimSubnetMusk(address)
 			}
 		}
-		localIPv4 = v4
-		localIPv6 = v6
-		macAddr = strings.ToLower(adapter.HardwareAddr.String())
-		adapterName = adapter.Name
-		break
 	}
-	if len(macAddr) == 0 {
-		return errors.New("no adapter available")
+	d := localDevice{ID: strings.ToLower(selected.HardwareAddr.String()), Adapter: selected.Name, IPv4: v4, IPv6: v6}
+	prev := device()
+	if d != prev {
+		currentDevice.Store(&d)
+	}
+	if len(prev.ID) > 0 && prev.ID != d.ID {
+		disconnectMQTT() // resubscribe the reply topic of the new ID
+		restartControl()
+	}
+
+	// Save the selected interface
+	if savedIdentity == nil || savedIdentity.ID != d.ID || savedIdentity.Adapter != d.Adapter {
+		if savedIdentity != nil && savedIdentity.ID != d.ID {
+			log.Printf("device id changed: %s (%s) -> %s (%s)", savedIdentity.ID, savedIdentity.Adapter, d.ID, d.Adapter)
+			idChangedFrom = savedIdentity.ID
+		}
+		savedIdentity = &identity{ID: d.ID, Adapter: d.Adapter}
+		if err := saveJSON(config().DataPath(identityFileName), savedIdentity); err != nil {
+			log.Printf("failed to save device id: %v", err)
+		}
+	}
+	return nil
+}
+
+// legacyIdentity returns the first up and assigned interface in the OS order, as selected by the previous versions.
+func legacyIdentity(adapters []net.Interface) *identity {
+	for _, adapter := range adapters {
+		if adapter.HardwareAddr == nil || !strings.Contains(adapter.Flags.String(), "up") {
+			continue
+		}
+		if addresses, err := adapter.Addrs(); err != nil || len(addresses) == 0 {
+			continue
+		}
+		return &identity{ID: strings.ToLower(adapter.HardwareAddr.String()), Adapter: adapter.Name}
 	}
 	return nil
 }
 
-func diskUsage(mountPoint string) (*diskUsageReport, error) {
+// takeIDChangedFrom returns and clears the previous ID if the ID has been changed.
+func takeIDChangedFrom() string {
+	id := idChangedFrom
+	idChangedFrom = ""
+	return id
+}
+
+// excludedAdapter reports whether the interface name matches to any of excluded patterns.
+func excludedAdapter(name string) bool {
+	for _, pattern := range config().IDExcludeInterfaces {
+		if matchName(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// physicalAdapter reports whether the interface is backed by a physical device.
+// All interfaces are treated as physical on the platforms other than Linux.
+func physicalAdapter(name string) bool {
+	if runtime.GOOS != "linux" {
+		return true
+	}
+	_, err := os.Stat(filepath.Join(sysfsRoot, "class", "net", name, "device"))
+	return err == nil
+}
+
+// matchName reports whether the name matches to the glob pattern.
+func matchName(pattern, name string) bool {
+	matched, err := filepath.Match(pattern, name)
+	return err == nil && matched
+}
+
+// diskUsages collects disk usages of the mount points, or all real filesystems if all is true.
+// Each mount point is collected independently, and errors of failed mount points are returned.
+func diskUsages(mountPoints []string, all bool) ([]diskUsageReport, []error) {
 	switch runtime.GOOS {
 	case "darwin":
 		raw, err := exec.Command("system_profiler", "-json", "SPStorageDataType").Output()
 		if err != nil {
-			return nil, err
+			return nil, []error{err}
 		}
 		var profile darwinSystemProfile
 		if err := json.Unmarshal(raw, &profile); err != nil {
-			return nil, err
+			return nil, []error{err}
+		}
+		var records []darwinStorageDataType
+		var errs []error
+		if all {
+			records = profile.Storage
+		} else {
+			for _, mountPoint := range mountPoints {
+				found := false
+				for _, record := range profile.Storage {
+					if record.MountPoint == mountPoint {
+						records = append(records, record)
+						found = true
+						break
+					}
+				}
+				if !found {
+					errs = append(errs, fmt.Errorf("no storage profile of %s", mountPoint))
+				}
+			}
 		}
-		for _, record := range profile.Storage {
-			if record.MountPoint == mountPoint {
-				return &diskUsageReport{
-					TotalBytes: record.TotalBytes,
-					UsedBytes:  record.TotalBytes - record.FreeBytes,
-					Label:      record.Name,
-					Filesystem: record.Filesystem,
-					MountPoint: record.MountPoint,
-					Device:     "/dev/" + record.BSDName,
-				}, nil
+		list := make([]diskUsageReport, 0, len(records))
+		for _, record := range records {
+			rep := diskUsageReport{
+				TotalBytes: record.TotalBytes,
+				UsedBytes:  record.TotalBytes - record.FreeBytes,
+				Label:      record.Name,
+				Filesystem: record.Filesystem,
+				MountPoint: record.MountPoint,
+				Device:     "/dev/" + record.BSDName,
 			}
+			if st, err := statfs(record.MountPoint); err == nil {
+				rep.InodesTotal = st.inodesTotal
+				rep.InodesUsed = st.inodesUsed
+				rep.ReadOnly = st.readOnly
+			}
+			list = append(list, rep)
 		}
-		return nil, fmt.Errorf("no storage profile: %s", string(raw))
+		return list, errs
 	case "linux":
-		raw, err := exec.Command("df", "-T", "-B", "1", mountPoint).Output()
+		mounts, err := readMounts(filepath.Join(procRoot, "self", "mounts"))
 		if err != nil {
-			return nil, err
-		}
-		lines := strings.Split(string(raw), "\n")
-		if len(lines) < 2 {
-			return nil, fmt.Errorf("no record: %s", string(raw))
+			return nil, []error{fmt.Errorf("failed to read mounts: %w", err)}
 		}
-		tokens := make([]string, 0)
-		for _, tok := range strings.Split(lines[1], " ") {
-			if len(tok) > 0 {
-				tokens = append(tokens, tok)
+		var targets []mount
+		var errs []error
+		if all {
+			targets = realMounts(mounts)
+		} else {
+			for _, mountPoint := range mountPoints {
+				if _, err := os.Stat(mountPoint); err != nil {
+					errs = append(errs, err)
+					continue
+				}
+				targets = append(targets, findMount(mounts, mountPoint))
 			}
 		}
-		if len(tokens) < 7 {
-			return nil, fmt.Errorf("invalid record: %s", lines[1])
-		}
-		used, err := strconv.ParseInt(tokens[3], 10, 64)
-		if err != nil {
-			return nil, fmt.Errorf("invalid record: %s", lines[1])
-		}
-		available, err := strconv.ParseInt(tokens[4], 10, 64)
-		if err != nil {
-			return nil, fmt.Errorf("invalid record: %s", lines[1])
+		var list []diskUsageReport
+		for _, m := range targets {
+			st, err := statfs(m.mountPoint)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", m.mountPoint, err))
+				continue
+			}
+			list = append(list, diskUsageReport{
+				TotalBytes:  st.totalBytes,
+				UsedBytes:   st.usedBytes,
+				Filesystem:  m.filesystem,
+				MountPoint:  m.mountPoint,
+				Device:      m.device,
+				InodesTotal: st.inodesTotal,
+				InodesUsed:  st.inodesUsed,
+				ReadOnly:    st.readOnly || m.readOnly,
+			})
 		}
-		return &diskUsageReport{
-			TotalBytes: used + available,
-			UsedBytes:  used,
-			Filesystem: tokens[1],
-			MountPoint: tokens[6],
-			Device:     tokens[0],
-		}, nil
+		return list, errs
 	default:
-		return nil, fmt.Errorf("unsupported platform: %s", runtime.GOOS)
+		return nil, []error{fmt.Errorf("unsupported platform: %s", runtime.GOOS)}
 	}
 }
 
@@ -161,24 +339,7 @@ func usbDevices() ([]usbDevice, error) {
 		}
 		return extractUSBProfile(profile.USB), nil
 	case "linux":
-		raw, err := exec.Command("lsusb").Output()
-		if err != nil {
-			return nil, err
-		}
-		var devices []usbDevice
-		for _, line := range strings.Split(string(raw), "\n") {
-			tokens := strings.Split(line, " ")
-			if len(tokens) < 7 {
-				continue
-			}
-			devices = append(devices, usbDevice{
-				Name:      strings.Join(tokens[6:], " "),
-				VendorID:  tokens[5][0:4],
-				ProductID: tokens[5][5:9],
-				Location:  strings.TrimRight(strings.Join(tokens[0:4], " "), ":"),
-			})
-		}
-		return devices, nil
+		return usbSysfsDevices(sysfsRoot)
 	default:
 		return nil, fmt.Errorf("unsupported platform: %s", runtime.GOOS)
 	}
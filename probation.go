@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	probationFileName = "update_probation.json"
+	rollbackFileName  = "update_rollback.json"
+)
+
+// probation defines the state of the updated binary until it proves healthy.
+type probation struct {
+	FromVersion string `json:"from_version"`
+	ToVersion   string `json:"to_version"`
+	StartTime   int64  `json:"start_time"` // First boot time of the updated binary (UTC)
+	succeeded   int
+	timer       *time.Timer
+}
+
+// rollbackRecord defines a record of the rolled back update.
+type rollbackRecord struct {
+	FailedVersion   string `json:"failed_version"`   // Version rolled back from
+	RestoredVersion string `json:"restored_version"` // Version rolled back to
+	Reason          string `json:"reason"`           // Reason of the rollback
+	Time            int64  `json:"time"`             // Time of the rollback (UTC)
+	Reported        bool   `json:"reported"`         // Uploaded to the server
+}
+
+var (
+	currentProbation *probation
+	lastRollback     *rollbackRecord
+	probationMutex   sync.Mutex
+)
+
+// beginProbation records the replaced binary to start probation on its boot.
+func beginProbation(newVer string) error {
+	if config().UpdateProbationReports <= 0 {
+		return nil
+	}
+	return saveJSON(config().DataPath(probationFileName), probation{FromVersion: ver, ToVersion: newVer})
+}
+
+// checkProbation restores update records, and starts probation if the running binary has just been updated.
+// The binary will be rolled back if it does not complete enough report uploads within the probation period.
+func checkProbation() {
+	if err := loadJSON(config().DataPath(rollbackFileName), &lastRollback); err != nil {
+		log.Printf("failed to load rollback record: %v", err)
+	}
+	var p *probation
+	if err := loadJSON(config().DataPath(probationFileName), &p); err != nil {
+		log.Printf("failed to load probation record: %v", err)
+	}
+	if p == nil {
+		return
+	}
+	if p.ToVersion != releaseVersion() {
+		log.Printf("discarding probation of version %s on version %s", p.ToVersion, ver)
+		safeRemove(config().DataPath(probationFileName))
+		return
+	}
+	if p.StartTime == 0 {
+		p.StartTime = time.Now().UTC().Unix()
+		if err := saveJSON(config().DataPath(probationFileName), p); err != nil {
+			log.Printf("failed to save probation record: %v", err)
+		}
+	}
+	deadline := time.Unix(p.StartTime, 0).Add(time.Duration(config().UpdateProbationMin) * time.Minute)
+	reason := fmt.Sprintf("less than %d successful report uploads within %d minutes", config().UpdateProbationReports, config().UpdateProbationMin)
+	if time.Now().After(deadline) {
+		rollback(p, reason)
+		return
+	}
+	log.Printf("version %s is on probation until %s", ver, deadline.Format(time.RFC3339))
+	probationMutex.Lock()
+	defer probationMutex.Unlock()
+	p.timer = time.AfterFunc(time.Until(deadline), func() { rollback(p, reason) })
+	currentProbation = p
+}
+
+// probationSucceeded counts a successful report upload, and confirms the update if enough uploads completed.
+func probationSucceeded() {
+	probationMutex.Lock()
+	defer probationMutex.Unlock()
+	if lastRollback != nil && !lastRollback.Reported {
+		lastRollback.Reported = true
+		if err := saveJSON(config().DataPath(rollbackFileName), lastRollback); err != nil {
+			log.Printf("failed to save rollback record: %v", err)
+		}
+	}
+	if currentProbation == nil {
+		return
+	}
+	currentProbation.succeeded++
+	if currentProbation.succeeded < config().UpdateProbationReports {
+		return
+	}
+	if !currentProbation.timer.Stop() {
+		return // rollback in progress
+	}
+	log.Printf("update %s -> %s confirmed", currentProbation.FromVersion, currentProbation.ToVersion)
+	safeRemove(config().DataPath(probationFileName))
+	currentProbation = nil
+}
+
+// pendingRollback returns the rollback record not reported yet.
+func pendingRollback() *rollbackRecord {
+	probationMutex.Lock()
+	defer probationMutex.Unlock()
+	if lastRollback == nil || lastRollback.Reported {
+		return nil
+	}
+	r := *lastRollback
+	return &r
+}
+
+// failedVersion returns the version rolled back from.
+func failedVersion() string {
+	probationMutex.Lock()
+	defer probationMutex.Unlock()
+	if lastRollback == nil {
+		return ""
+	}
+	return lastRollback.FailedVersion
+}
+
+// rollback restores the previous binary and restarts the process.
+func rollback(p *probation, reason string) {
+	log.Printf("rolling back version %s to %s: %s", p.ToVersion, p.FromVersion, reason)
+	if err := moveFile(os.Args[0]+".old", os.Args[0]); err != nil {
+		deferError("failed to roll back version %s: %v", p.ToVersion, err)
+		return
+	}
+	if runtime.GOOS != "windows" {
+		if err := os.Chmod(os.Args[0], 0775); err != nil {
+			log.Printf("failed to chmod: %s", os.Args[0])
+		}
+	}
+	record := rollbackRecord{
+		FailedVersion:   p.ToVersion,
+		RestoredVersion: p.FromVersion,
+		Reason:          reason,
+		Time:            time.Now().UTC().Unix(),
+	}
+	if err := saveJSON(config().DataPath(rollbackFileName), record); err != nil {
+		log.Printf("failed to save rollback record: %v", err)
+	}
+	safeRemove(config().DataPath(probationFileName))
+	if len(config().UpdateCommand) > 0 {
+		log.Print("rollback complete. now executing restart...")
+		restart()
+		os.Exit(1) // leave restart to the service manager if the restart command did not stop this process
+	}
+	log.Print("rollback complete. please restart process manually.")
+}
+
+// loadJSON loads the JSON file to v. Missing file is not an error.
+func loadJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// saveJSON saves v to the JSON file.
+func saveJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
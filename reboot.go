@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+const rebootIDFileName = "reboot_id"
+
+var (
+	rebootID    string // ID of the last accepted reboot request, guarded by rebootMutex
+	rebootMutex sync.Mutex
+)
+
+// loadRebootID restores the ID of the last accepted reboot request from the data directory.
+func loadRebootID() {
+	data, err := os.ReadFile(config().DataPath(rebootIDFileName))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("failed to load last reboot request id: %v", err)
+		}
+		return
+	}
+	rebootMutex.Lock()
+	defer rebootMutex.Unlock()
+	rebootID = strings.TrimSpace(string(data))
+}
+
+// acceptedRebootID returns the ID of the last accepted reboot request.
+func acceptedRebootID() string {
+	rebootMutex.Lock()
+	defer rebootMutex.Unlock()
+	return rebootID
+}
+
+// handleRebootRequest accepts the reboot request only once per request ID, even across restarts.
+func handleRebootRequest(id string) {
+	if len(id) == 0 {
+		deferError("reboot request ignored: no request id")
+		return
+	}
+	rebootMutex.Lock()
+	defer rebootMutex.Unlock()
+	if id == rebootID {
+		return // already accepted
+	}
+	if err := os.WriteFile(config().DataPath(rebootIDFileName), []byte(id+"\n"), 0600); err != nil {
+		deferError("reboot request %s ignored: failed to save request id: %v", id, err)
+		return
+	}
+	rebootID = id
+	if len(config().RebootCommand) == 0 {
+		deferError("reboot request %s ignored: no reboot command configured", id)
+		return
+	}
+	log.Printf("reboot request %s accepted", id)
+	go func() {
+		doReport(triggerReboot)
+		runCommand(config().RebootCommand)
+	}()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// configMutex serializes reading and applying of the local and remote configurations.
+var configMutex sync.Mutex
+
+// watchConfig reloads the configuration file on SIGHUP or when the file is modified.
+func watchConfig() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(configWatchGapSec * time.Second)
+	defer ticker.Stop()
+	last := configFileStamp()
+	for {
+		select {
+		case <-hup:
+			log.Print("SIGHUP received, reloading configuration")
+			last = configFileStamp()
+		case <-ticker.C:
+			stamp := configFileStamp()
+			if stamp == last {
+				continue
+			}
+			last = stamp
+			log.Printf("%s modified, reloading configuration", *configPath)
+		}
+		reloadConfig()
+	}
+}
+
+// configFileStamp returns modification time and size of the configuration file.
+func configFileStamp() string {
+	stat, err := os.Stat(*configPath)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d/%d", stat.ModTime().UnixNano(), stat.Size())
+}
+
+// reloadConfig reads the configuration file and applies it. Current configuration is kept if the file is broken.
+func reloadConfig() {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	c, err := readConfig(*configPath)
+	if err != nil {
+		log.Printf("failed to reload configuration, keeping current one: %v", err)
+		return
+	}
+	applyConfig(c)
+}
+
+// applyConfig activates the configuration and restarts components affected by the changes.
+// Callers must hold configMutex.
+func applyConfig(c *Config) {
+	old := activeConfig.Swap(c)
+	if old == nil {
+		return
+	}
+	if c.ReportIntervalMin != old.ReportIntervalMin {
+		log.Printf("report interval changed: %d -> %d min", old.ReportIntervalMin, c.ReportIntervalMin)
+		reportTicker.Reset(time.Duration(c.ReportIntervalMin) * time.Minute)
+	}
+	if sshConfigChanged(old, c) {
+		log.Print("ssh configuration changed, restarting ssh connection")
+		restartSSH()
+	}
+	if mqttConfigChanged(old, c) {
+		log.Print("mqtt configuration changed, disconnecting mqtt broker")
+		disconnectMQTT()
+	}
+	if c.LocalAPIEnabled != old.LocalAPIEnabled || c.LocalAPIListen != old.LocalAPIListen {
+		stopLocalAPI()
+		if c.LocalAPIEnabled {
+			startLocalAPI()
+		}
+	}
+	if c.MetricsListen != old.MetricsListen {
+		stopMetricsServer()
+		if len(c.MetricsListen) > 0 {
+			startMetricsServer()
+		}
+	}
+	if c.ControlEnabled != old.ControlEnabled || c.ControlPath != old.ControlPath {
+		stopControl()
+		if c.ControlEnabled {
+			startControl()
+		}
+	}
+	if c.UpdateEnabled && !old.UpdateEnabled {
+		startUpdateChecker()
+	}
+	if !c.UpdateEnabled && old.UpdateEnabled {
+		stopUpdateChecker()
+	}
+	if c.UpdateEnabled && old.UpdateEnabled && !reflect.DeepEqual(c.UpdatePublicKeys, old.UpdatePublicKeys) {
+		log.Print("update public keys changed, checking update")
+		stopUpdateChecker()
+		startUpdateChecker()
+	}
+}
+
+// sshConfigChanged reports whether any of configuration parameters of the SSH connection are changed.
+func sshConfigChanged(old, c *Config) bool {
+	return old.SSHEnabled != c.SSHEnabled ||
+		old.SSHLocal() != c.SSHLocal() ||
+		old.SSHHostKeyCheck != c.SSHHostKeyCheck ||
+		old.SSHKnownHostsFile != c.SSHKnownHostsFile ||
+		!reflect.DeepEqual(old.SSHForwards, c.SSHForwards)
+}
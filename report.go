@@ -12,70 +12,132 @@ import (
 	"os/exec"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 )
 
+// Report triggers other than the timer (positive values are the report interval in minutes).
+const (
+	triggerConnected = -1 // SSH tunnel connected
+	triggerBoot      = 0  // Agent started
+	triggerReboot    = -2 // Reboot request accepted
+	triggerEvent     = -3 // Device or network event detected
+	triggerLocalAPI  = -4 // Requested by the local API
+	triggerControl   = -5 // Requested through the control channel
+)
+
 // report defines all of report attributes
 type report struct {
-	ID             string      `json:"id"`                         // MAC address of the primary network interface
-	Trigger        int         `json:"trigger"`                    // Report trigger (-1: connected, 0: boot, n: timer)
-	Runtime        string      `json:"runtime"`                    // OS and arch
-	Success        bool        `json:"success"`                    // Equals len(Errors) == 0
-	Sequence       int         `json:"seq"`                        // Report sequence number from process start
-	DeviceTime     int64       `json:"device_time"`                // Device time (UTC) by time.Now().UTC().Unix()
-	BootTime       int64       `json:"boot_time"`                  // Device boot time (UTC)
-	GenMillis      int64       `json:"gen_ms"`                     // Generation time milliseconds
-	AgentVersion   string      `json:"agent_version"`              // Agent version
-	CustomID       string      `json:"custom_id,omitempty"`        // User specified ID
-	SSHServerHost  string      `json:"ssh_server_host,omitempty"`  // Connected SSH server host
-	SSHRemotePort  int         `json:"ssh_remote_port,omitempty"`  // Connected SSH remote port
-	SSHConnectTime int64       `json:"ssh_connect_time,omitempty"` // Connected time of the SSH
-	Adapter        string      `json:"adapter,omitempty"`          // Name of network adapter, source of the MAC address
-	LocalIPv4      string      `json:"ip4_local,omitempty"`        // Local IPv6 address
-	LocalIPv6      string      `json:"ip6_local,omitempty"`        // Local IPv6 address
-	Hostname       string      `json:"hostname,omitempty"`         // OS Hostname
-	RTTMills       int64       `json:"rtt_ms,omitempty"`           // Round trip time milliseconds
-	UploadKBPS     int64       `json:"upload_bps,omitempty"`       // Upload throughput bps
-	DownloadKBPS   int64       `json:"download_bps,omitempty"`     // Download throughput bps
-	DiskTotalBytes int64       `json:"disk_total_bytes,omitempty"` // Total disk space (Bytes)
-	DiskUsedBytes  int64       `json:"disk_used_bytes,omitempty"`  // Used disk space (Bytes)
-	DiskLabel      string      `json:"disk_label,omitempty"`       // Disk label
-	DiskFilesystem string      `json:"disk_filesystem,omitempty"`  // Disk filesystem name
-	DiskMountPoint string      `json:"disk_mount_point,omitempty"` // Mount point (default is root)
-	DiskDevice     string      `json:"disk_device,omitempty"`      // Disk device name
-	USBDevices     []usbDevice `json:"usb_devices,omitempty"`      // List of usb devices
-	BDLocalDevices []string    `json:"bd_local_devices,omitempty"` // List of Bluetooth local devices
-	KernelVersion  string      `json:"kernel_version,omitempty"`   // Kernel version
-	Errors         []string    `json:"errors,omitempty"`           // List of errors
-	Payload        string      `json:"payload,omitempty"`          // Custom content provided by payload command
-	PayloadCmd     string      `json:"payload_cmd,omitempty"`      // Executed payload command
+	ID             string                 `json:"id"`                           // MAC address of the primary network interface
+	Trigger        int                    `json:"trigger"`                      // Report trigger (-5: control, -4: local api, -3: event, -2: reboot, -1: connected, 0: boot, n: timer)
+	Runtime        string                 `json:"runtime"`                      // OS and arch
+	Success        bool                   `json:"success"`                      // Equals len(Errors) == 0
+	Sequence       int                    `json:"seq"`                          // Report sequence number from process start
+	DeviceTime     int64                  `json:"device_time"`                  // Device time (UTC) by time.Now().UTC().Unix()
+	BootTime       int64                  `json:"boot_time"`                    // Device boot time (UTC)
+	GenMillis      int64                  `json:"gen_ms"`                       // Generation time milliseconds
+	AgentVersion   string                 `json:"agent_version"`                // Agent version
+	CustomID       string                 `json:"custom_id,omitempty"`          // User specified ID
+	IDChangedFrom  string                 `json:"id_changed_from,omitempty"`    // Previous ID if the ID has been changed
+	Events         []string               `json:"events,omitempty"`             // Detected events since the last report
+	SSHServerHost  string                 `json:"ssh_server_host,omitempty"`    // Connected SSH server host
+	SSHRemotePort  int                    `json:"ssh_remote_port,omitempty"`    // Connected SSH remote port
+	SSHRemotePorts map[string]int         `json:"ssh_remote_ports,omitempty"`   // Connected SSH remote ports by forward names
+	SSHTunnelStats map[string]tunnelStats `json:"ssh_tunnel_stats,omitempty"`   // SSH tunnel connection statistics by forward names
+	SSHConnectTime int64                  `json:"ssh_connect_time,omitempty"`   // Connected time of the SSH
+	SSHTunnelState string                 `json:"ssh_tunnel_state,omitempty"`   // SSH tunnel state (disabled, closed, idle_closed, connecting, open)
+	SSHKeepaliveMs int64                  `json:"ssh_keepalive_ms,omitempty"`   // Round trip time of the last SSH keepalive
+	SSHReconnects  int64                  `json:"ssh_reconnects,omitempty"`     // Number of SSH reconnections
+	Adapter        string                 `json:"adapter,omitempty"`            // Name of network adapter, source of the MAC address
+	LocalIPv4      string                 `json:"ip4_local,omitempty"`          // Local IPv6 address
+	LocalIPv6      string                 `json:"ip6_local,omitempty"`          // Local IPv6 address
+	Hostname       string                 `json:"hostname,omitempty"`           // OS Hostname
+	RTTMills       int64                  `json:"rtt_ms,omitempty"`             // Round trip time milliseconds
+	UploadKBPS     int64                  `json:"upload_bps,omitempty"`         // Upload throughput bps
+	DownloadKBPS   int64                  `json:"download_bps,omitempty"`       // Download throughput bps
+	DiskTotalBytes int64                  `json:"disk_total_bytes,omitempty"`   // Total disk space (Bytes)
+	DiskUsedBytes  int64                  `json:"disk_used_bytes,omitempty"`    // Used disk space (Bytes)
+	DiskLabel      string                 `json:"disk_label,omitempty"`         // Disk label
+	DiskFilesystem string                 `json:"disk_filesystem,omitempty"`    // Disk filesystem name
+	DiskMountPoint string                 `json:"disk_mount_point,omitempty"`   // Mount point (default is root)
+	DiskDevice     string                 `json:"disk_device,omitempty"`        // Disk device name
+	Disks          []diskUsageReport      `json:"disks,omitempty"`              // Disk usages of all mount points
+	USBDevices     []usbDevice            `json:"usb_devices,omitempty"`        // List of usb devices
+	BDLocalDevices []string               `json:"bd_local_devices,omitempty"`   // List of Bluetooth local devices
+	KernelVersion  string                 `json:"kernel_version,omitempty"`     // Kernel version
+	CPUUsage       float64                `json:"cpu_usage_percent,omitempty"`  // CPU usage percent since the last report
+	MemTotalBytes  int64                  `json:"mem_total_bytes,omitempty"`    // Total memory (Bytes)
+	MemUsedBytes   int64                  `json:"mem_used_bytes,omitempty"`     // Used memory excluding caches (Bytes)
+	SwapTotalBytes int64                  `json:"swap_total_bytes,omitempty"`   // Total swap space (Bytes)
+	SwapUsedBytes  int64                  `json:"swap_used_bytes,omitempty"`    // Used swap space (Bytes)
+	LoadAverage1   float64                `json:"load_avg_1,omitempty"`         // Load average of 1 minute
+	LoadAverage5   float64                `json:"load_avg_5,omitempty"`         // Load average of 5 minutes
+	LoadAverage15  float64                `json:"load_avg_15,omitempty"`        // Load average of 15 minutes
+	UptimeSec      int64                  `json:"uptime_sec,omitempty"`         // OS uptime seconds
+	Sensors        []sensor               `json:"sensors,omitempty"`            // Hardware sensors (temperature, voltage, etc.)
+	Throttling     *throttling            `json:"throttling,omitempty"`         // Throttling and under-voltage flags
+	Interfaces     []networkInterface     `json:"network_interfaces,omitempty"` // All network interfaces with traffic counters
+	Errors         []string               `json:"errors,omitempty"`             // List of errors
+	Payload        string                 `json:"payload,omitempty"`            // Custom content provided by payload command
+	PayloadCmd     string                 `json:"payload_cmd,omitempty"`        // Executed payload command
+	RebootID       string                 `json:"reboot_id,omitempty"`          // Last accepted reboot request ID
+	Rollback       *rollbackRecord        `json:"rollback,omitempty"`           // Rolled back update not reported yet
+	JobResults     []jobResult            `json:"job_results,omitempty"`        // Results of jobs finished since the last report
+	ConfigVersion  string                 `json:"config_version,omitempty"`     // Version of the applied remote configuration
+	ControlOnline  bool                   `json:"control_connected,omitempty"`  // Control channel is connected
 }
 
 type usbDevice struct {
-	Name      string `json:"name,omitempty"`
-	VendorID  string `json:"vendor_id,omitempty"`
-	ProductID string `json:"product_id,omitempty"`
-	Location  string `json:"location,omitempty"`
+	Name         string  `json:"name,omitempty"`
+	VendorID     string  `json:"vendor_id,omitempty"`
+	ProductID    string  `json:"product_id,omitempty"`
+	Location     string  `json:"location,omitempty"`
+	Manufacturer string  `json:"manufacturer,omitempty"` // Manufacturer string descriptor
+	Product      string  `json:"product,omitempty"`      // Product string descriptor
+	Serial       string  `json:"serial,omitempty"`       // Serial number string descriptor
+	Bus          int     `json:"bus,omitempty"`          // Bus number
+	PortPath     string  `json:"port_path,omitempty"`    // Port path from the root hub (ex. 1.2)
+	SpeedMbps    float64 `json:"speed_mbps,omitempty"`   // Negotiated speed (Mbps)
+	Class        string  `json:"class,omitempty"`        // Device class code in hex (ex. 09 for hub)
 }
 
 // reply defines all of reply message attributes
 type reply struct {
-	Reboot        bool   `json:"reboot,omitempty"` // Reboot requested from the server
-	SSHServerHost string `json:"ssh_host,omitempty"`
-	SSHServerPort int    `json:"ssh_port,omitempty"`
-	SSHServerUser string `json:"ssh_user,omitempty"`
-	SSHKey        string `json:"ssh_key,omitempty"`
-	SSHPassword   string `json:"ssh_password,omitempty"`
+	Reboot        bool            `json:"reboot,omitempty"`    // Reboot requested from the server
+	RebootID      string          `json:"reboot_id,omitempty"` // Unique ID of the reboot request
+	SSHServerHost string          `json:"ssh_host,omitempty"`
+	SSHServerPort int             `json:"ssh_port,omitempty"`
+	SSHServerUser string          `json:"ssh_user,omitempty"`
+	SSHKey        string          `json:"ssh_key,omitempty"`
+	SSHPassword   string          `json:"ssh_password,omitempty"`
+	SSHHostKey    string          `json:"ssh_host_key,omitempty"`   // Fingerprint of the SSH server host key
+	Jobs          []job           `json:"jobs,omitempty"`           // Commands to execute
+	SSHForwards   []sshForward    `json:"ssh_forwards,omitempty"`   // Additional local endpoints to forward
+	SSHWanted     *bool           `json:"ssh_wanted,omitempty"`     // Open (true) or close (false) the SSH tunnel on demand
+	Config        json.RawMessage `json:"config,omitempty"`         // Partial configuration override
+	ConfigVersion string          `json:"config_version,omitempty"` // Version of the configuration override
 }
 
-var seq = 0
+var (
+	seq                 = 0
+	reportMutex         sync.Mutex
+	deferredErrors      []string
+	deferredErrorsMutex sync.Mutex
+	replyMutex          sync.Mutex // Serializes replies received from the HTTP, MQTT and control channel paths
+	uploadRetry         backoff
+	uploadRetryTimer    *time.Timer // Scheduled upload retry, guarded by reportMutex
+	failedReport        []byte      // Last failed report, guarded by reportMutex
+)
 
 // doReport generates and uploads a record.
 func doReport(trigger int) {
+	reportMutex.Lock()
+	defer reportMutex.Unlock()
 	if err := initID(); err != nil {
 		log.Printf("failed to rescan ID: %v", err)
 	}
 	report := genReport(trigger)
+	recordReport(report)
 	var data []byte
 	var err error
 	if *debugPrint {
@@ -90,42 +152,103 @@ func doReport(trigger int) {
 			log.Fatalf("failed to marshal report: %v", err)
 		}
 	}
-	if strings.Contains(config.Server, "localhost") {
-		if err := uploadReport(data, "http"); err != nil {
-			log.Printf("failed to upload report: %v", err)
-		}
-	} else {
-		if err := uploadReport(data, "https"); err != nil {
-			if strings.HasPrefix(err.Error(), "failed to upload with https:") {
-				if err := uploadReport(data, "http"); err != nil {
-					log.Printf("failed to upload report: %v", err)
-				}
-			} else {
-				log.Printf("failed to upload report: %v", err)
+	err = upload(data)
+	recordUpload(err)
+	if err != nil {
+		log.Printf("failed to upload report: %v", err)
+		if config().SpoolEnabled {
+			if err := spoolReport(data); err != nil {
+				log.Printf("failed to spool report: %v", err)
 			}
 		}
+		scheduleUploadRetry(data)
+		return
+	}
+	cancelUploadRetry()
+	probationSucceeded()
+	if config().SpoolEnabled {
+		drainSpool()
+	}
+}
+
+// scheduleUploadRetry schedules a retry of the failed report with backoff, unless a retry is already scheduled.
+// It must be called while holding reportMutex.
+func scheduleUploadRetry(data []byte) {
+	failedReport = data
+	if config().UploadRetryMinSec <= 0 || uploadRetryTimer != nil {
+		return
+	}
+	delay := uploadRetry.retryDelay(config().UploadRetryMinSec, config().UploadRetryMaxSec)
+	log.Printf("retrying upload after %v...", delay.Round(time.Second))
+	uploadRetryTimer = time.AfterFunc(delay, retryUpload)
+}
+
+// cancelUploadRetry cancels the scheduled retry and resets the backoff after a successful upload.
+// It must be called while holding reportMutex.
+func cancelUploadRetry() {
+	if uploadRetryTimer != nil {
+		uploadRetryTimer.Stop()
+		uploadRetryTimer = nil
 	}
+	failedReport = nil
+	uploadRetry.reset()
+}
+
+// retryUpload uploads spooled reports, or the last failed report if the spool is disabled.
+func retryUpload() {
+	reportMutex.Lock()
+	defer reportMutex.Unlock()
+	uploadRetryTimer = nil
+	var err error
+	if config().SpoolEnabled {
+		err = drainSpool()
+	} else if failedReport != nil {
+		err = upload(failedReport)
+	}
+	recordUpload(err)
+	if err != nil {
+		log.Printf("failed to retry upload: %v", err)
+		scheduleUploadRetry(failedReport)
+		return
+	}
+	cancelUploadRetry()
+	probationSucceeded()
 }
 
 // genReport generates a report.
 func genReport(trigger int) report {
 	seq++
 	timeBegin := time.Now()
+	connectTime, remotePort := sshConnection()
+	d := device()
 	report := report{
-		ID:             macAddr,
+		ID:             d.ID,
 		Trigger:        trigger,
-		CustomID:       config.CustomID,
+		CustomID:       config().CustomID,
+		IDChangedFrom:  takeIDChangedFrom(),
+		Events:         takeEvents(),
 		BootTime:       bootTime.Unix(),
-		SSHServerHost:  msg.SSHServerHost,
-		SSHRemotePort:  sshRemotePort,
-		SSHConnectTime: sshConnectTime.Unix(),
+		SSHServerHost:  sshReply().SSHServerHost,
+		SSHRemotePort:  remotePort,
+		SSHRemotePorts: remotePorts(),
+		SSHTunnelStats: tunnelStatsSnapshot(),
+		SSHConnectTime: connectTime.Unix(),
+		SSHTunnelState: tunnelState(),
+		SSHKeepaliveMs: sshKeepaliveMs.Load(),
+		SSHReconnects:  sshReconnects(),
 		Sequence:       seq,
-		Adapter:        adapterName,
-		LocalIPv6:      localIPv6,
-		LocalIPv4:      localIPv4,
+		Adapter:        d.Adapter,
+		LocalIPv6:      d.IPv6,
+		LocalIPv4:      d.IPv4,
 		Runtime:        runtime.GOOS + " " + runtime.GOARCH,
 		AgentVersion:   ver,
 		KernelVersion:  kernelVersion(),
+		RebootID:       acceptedRebootID(),
+		Rollback:       pendingRollback(),
+		JobResults:     takeJobResults(),
+		ConfigVersion:  config().Version,
+		ControlOnline:  controlConnected.Load(),
+		Errors:         takeDeferredErrors(),
 	}
 
 	// Get hostname
@@ -136,26 +259,69 @@ func genReport(trigger int) report {
 	report.Hostname = hostname
 
 	// Platform information
-	if config.DiskUsageEnabled {
-		if rep, err := diskUsage(config.DiskUsageMountPoint); err != nil {
+	if config().DiskUsageEnabled {
+		mountPoints := config().DiskUsageMountPoints
+		if len(mountPoints) == 0 {
+			mountPoints = []string{config().DiskUsageMountPoint}
+		}
+		rep, errs := diskUsages(mountPoints, config().DiskUsageAllMounts)
+		for _, err := range errs {
 			report.Errors = append(report.Errors, fmt.Sprintf("failed to obtain disk usage: %v", err))
+		}
+		if len(rep) > 0 {
+			report.DiskTotalBytes = rep[0].TotalBytes
+			report.DiskUsedBytes = rep[0].UsedBytes
+			report.DiskLabel = rep[0].Label
+			report.DiskFilesystem = rep[0].Filesystem
+			report.DiskMountPoint = rep[0].MountPoint
+			report.DiskDevice = rep[0].Device
+			report.Disks = rep
+		}
+	}
+	if config().SystemMetricsEnabled {
+		rep, errs := systemMetrics(procRoot)
+		for _, err := range errs {
+			report.Errors = append(report.Errors, fmt.Sprintf("failed to obtain system metrics: %v", err))
+		}
+		if rep != nil {
+			report.CPUUsage = rep.CPUUsagePercent
+			report.MemTotalBytes = rep.MemTotalBytes
+			report.MemUsedBytes = rep.MemUsedBytes
+			report.SwapTotalBytes = rep.SwapTotalBytes
+			report.SwapUsedBytes = rep.SwapUsedBytes
+			report.LoadAverage1 = rep.LoadAverage1
+			report.LoadAverage5 = rep.LoadAverage5
+			report.LoadAverage15 = rep.LoadAverage15
+			report.UptimeSec = rep.UptimeSec
+		}
+	}
+	if config().SensorsEnabled {
+		if rep, err := sensors(sysfsRoot); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("failed to obtain sensors: %v", err))
 		} else {
-			report.DiskTotalBytes = rep.TotalBytes
-			report.DiskUsedBytes = rep.UsedBytes
-			report.DiskLabel = rep.Label
-			report.DiskFilesystem = rep.Filesystem
-			report.DiskMountPoint = rep.MountPoint
-			report.DiskDevice = rep.Device
+			report.Sensors = rep
+		}
+		if rep, err := throttlingFlags(sysfsRoot); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("failed to obtain throttling flags: %v", err))
+		} else {
+			report.Throttling = rep
 		}
 	}
-	if config.USBScanEnabled {
+	if config().InterfacesEnabled {
+		if rep, err := networkInterfaces(procRoot); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("failed to obtain network interfaces: %v", err))
+		} else {
+			report.Interfaces = rep
+		}
+	}
+	if config().USBScanEnabled {
 		if rep, err := usbDevices(); err != nil {
 			report.Errors = append(report.Errors, fmt.Sprintf("failed to obtain list of usb devices: %v", err))
 		} else {
 			report.USBDevices = rep
 		}
 	}
-	if config.BTScanEnabled {
+	if config().BTScanEnabled {
 		if rep, err := bdLocalDevices(); err != nil {
 			report.Errors = append(report.Errors, fmt.Sprintf("failed to obtain list of bluetooth devices: %v", err))
 		} else {
@@ -163,16 +329,16 @@ func genReport(trigger int) report {
 		}
 	}
 
-	// Measurements
-	if config.RTTEnabled {
+	// Measurements (skipped if no server to measure against, ex. MQTT transport only)
+	if config().RTTEnabled && len(config().Server) > 0 {
 		if rtt, err := measureRoundTripTimeMills(); err != nil {
 			report.Errors = append(report.Errors, fmt.Sprintf("failed to measure rtt: %v", err))
 		} else {
 			report.RTTMills = rtt
 		}
 	}
-	if config.ThroughputEnabled && config.ThroughputKB >= 0 {
-		if downKBPS, upKBPS, err := measureThroughput(config.ThroughputKB); err != nil {
+	if config().ThroughputEnabled && config().ThroughputKB >= 0 && len(config().Server) > 0 {
+		if downKBPS, upKBPS, err := measureThroughput(config().ThroughputKB); err != nil {
 			report.Errors = append(report.Errors, fmt.Sprintf("failed to measure throughput: %v", err))
 		} else {
 			report.DownloadKBPS = downKBPS
@@ -181,9 +347,9 @@ func genReport(trigger int) report {
 	}
 
 	// Payload
-	if len(config.PayloadCommand) > 0 {
-		report.PayloadCmd = config.PayloadCommand
-		param := strings.Split(config.PayloadCommand, " ")
+	if len(config().PayloadCommand) > 0 {
+		report.PayloadCmd = config().PayloadCommand
+		param := strings.Split(config().PayloadCommand, " ")
 		name := param[0]
 		args := make([]string, 0)
 		if len(param) > 1 {
@@ -206,6 +372,21 @@ func genReport(trigger int) report {
 	return report
 }
 
+// upload uploads a report using https with fallback to http.
+func upload(data []byte) error {
+	if config().Transport == transportMQTT {
+		return uploadMQTT(data)
+	}
+	if strings.Contains(config().Server, "localhost") {
+		return uploadReport(data, "http")
+	}
+	err := uploadReport(data, "https")
+	if err != nil && strings.HasPrefix(err.Error(), "failed to upload with https:") {
+		return uploadReport(data, "http")
+	}
+	return err
+}
+
 // uploadReport uploads a report with specified proto (http or https).
 func uploadReport(report []byte, proto string) error {
 	gz := new(bytes.Buffer)
@@ -216,11 +397,11 @@ func uploadReport(report []byte, proto string) error {
 	if err := w.Close(); err != nil {
 		return fmt.Errorf("failed to close gzipped report: %v", err)
 	}
-	req, err := http.NewRequest(http.MethodPost, proto+"://"+config.Server+"/report", gz)
+	req, err := http.NewRequest(http.MethodPost, proto+"://"+config().Server+"/report", gz)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
-	req.Header.Set("Authorization", "token "+config.APIKey)
+	req.Header.Set("Authorization", "token "+config().APIKey)
 	req.Header.Set("Content-Encoding", "gzip")
 	req.Header.Set("Accept-Encoding", "gzip")
 	resp, err := new(http.Client).Do(req)
@@ -248,12 +429,57 @@ func uploadReport(report []byte, proto string) error {
 		return fmt.Errorf("failed to unmarshal response: %w", err)
 	}
 
+	handleReply(serverMessage)
+	return nil
+}
+
+// handleReply applies instructions of the reply message from the server.
+// Replies are handled one by one because they can arrive through several paths at the same time.
+func handleReply(r reply) {
+	replyMutex.Lock()
+	defer replyMutex.Unlock()
+	recordReply(r)
+	if r.Reboot {
+		handleRebootRequest(r.RebootID)
+	}
+	if len(r.Jobs) > 0 {
+		handleJobs(r.Jobs)
+	}
+	if len(r.Config) > 0 {
+		handleConfigOverride(r.ConfigVersion, r.Config)
+	}
+
 	// Start listening SSH if not started
-	if config.SSHEnabled {
-		msg = serverMessage
+	if config().SSHEnabled {
+		setSSHReply(r)
+		if r.SSHWanted != nil {
+			setTunnelWanted(*r.SSHWanted)
+		}
 		sshLoopStarted.Do(func() { go listenSSH() })
 	}
-	return nil
+}
+
+// deferError records an error occurred outside of the report generation to include it in the next report.
+func deferError(format string, a ...interface{}) {
+	text := fmt.Sprintf(format, a...)
+	log.Print(text)
+	deferredErrorsMutex.Lock()
+	defer deferredErrorsMutex.Unlock()
+	for _, e := range deferredErrors {
+		if e == text {
+			return // already recorded
+		}
+	}
+	deferredErrors = append(deferredErrors, text)
+}
+
+// takeDeferredErrors returns and clears all of deferred errors.
+func takeDeferredErrors() []string {
+	deferredErrorsMutex.Lock()
+	defer deferredErrorsMutex.Unlock()
+	errs := deferredErrors
+	deferredErrors = nil
+	return errs
 }
 
 // SSHServer returns SSH server host and port with colon separator.
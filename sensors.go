@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const sysfsRoot = "/sys"
+
+// sensor defines a reading of a hardware sensor.
+type sensor struct {
+	Name  string  `json:"name"`  // Source of the sensor (ex. thermal_zone0, hwmon1/cpu_thermal/temp1)
+	Label string  `json:"label"` // Label of the sensor (ex. cpu-thermal, Core 0)
+	Value float64 `json:"value"` // Value of the sensor in the unit
+	Unit  string  `json:"unit"`  // Unit of the value (°C, V, A, W or RPM)
+}
+
+// throttling defines throttling and under-voltage flags of the board.
+type throttling struct {
+	Raw                   string `json:"raw,omitempty"`                      // Raw value of the flags if available
+	UnderVoltage          bool   `json:"under_voltage"`                      // Under-voltage detected
+	FreqCapped            bool   `json:"freq_capped"`                        // ARM frequency capped
+	Throttled             bool   `json:"throttled"`                          // Currently throttled
+	SoftTempLimit         bool   `json:"soft_temp_limit"`                    // Soft temperature limit active
+	UnderVoltageOccurred  bool   `json:"under_voltage_occurred,omitempty"`   // Under-voltage has occurred since boot
+	FreqCappedOccurred    bool   `json:"freq_capped_occurred,omitempty"`     // ARM frequency capping has occurred since boot
+	ThrottledOccurred     bool   `json:"throttled_occurred,omitempty"`       // Throttling has occurred since boot
+	SoftTempLimitOccurred bool   `json:"soft_temp_limit_occurred,omitempty"` // Soft temperature limit has occurred since boot
+}
+
+// hwmon sensor types by file name prefix, with the divisor to convert into the unit.
+var hwmonTypes = map[string]struct {
+	unit    string
+	divisor float64
+}{
+	"temp":  {"°C", 1000},
+	"in":    {"V", 1000},
+	"curr":  {"A", 1000},
+	"power": {"W", 1000000},
+	"fan":   {"RPM", 1},
+}
+
+var hwmonInputPattern = regexp.MustCompile(`^(temp|in|curr|power|fan)(\d+)_input$`)
+
+// sensors collects all of thermal zones and hwmon sensors from the sysfs.
+func sensors(root string) ([]sensor, error) {
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("unsupported platform: %s", runtime.GOOS)
+	}
+	zones, zonesErr := thermalZones(root)
+	hwmons, hwmonsErr := hwmonSensors(root)
+	if zonesErr != nil && hwmonsErr != nil {
+		return nil, fmt.Errorf("no sensor sources: %v, %v", zonesErr, hwmonsErr)
+	}
+	return append(zones, hwmons...), nil
+}
+
+// thermalZones reads temperatures of /sys/class/thermal/thermal_zone*.
+func thermalZones(root string) ([]sensor, error) {
+	dir := filepath.Join(root, "class", "thermal")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var list []sensor
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "thermal_zone") {
+			continue
+		}
+		temp, err := readInt(filepath.Join(dir, entry.Name(), "temp"))
+		if err != nil {
+			continue // disabled or unreadable zone
+		}
+		list = append(list, sensor{
+			Name:  entry.Name(),
+			Label: readString(filepath.Join(dir, entry.Name(), "type")),
+			Value: float64(temp) / 1000,
+			Unit:  "°C",
+		})
+	}
+	return list, nil
+}
+
+// hwmonSensors reads temperature, voltage, current, power and fan inputs of /sys/class/hwmon/hwmon*.
+func hwmonSensors(root string) ([]sensor, error) {
+	dir := filepath.Join(root, "class", "hwmon")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var list []sensor
+	for _, entry := range entries {
+		hwmonDir := filepath.Join(dir, entry.Name())
+		files, err := os.ReadDir(hwmonDir)
+		if err != nil {
+			continue
+		}
+		name := readString(filepath.Join(hwmonDir, "name"))
+		var names []string
+		for _, f := range files {
+			if hwmonInputPattern.MatchString(f.Name()) {
+				names = append(names, f.Name())
+			}
+		}
+		sort.Strings(names)
+		for _, input := range names {
+			value, err := readInt(filepath.Join(hwmonDir, input))
+			if err != nil {
+				continue
+			}
+			id := strings.TrimSuffix(input, "_input")
+			label := readString(filepath.Join(hwmonDir, id+"_label"))
+			if len(label) == 0 {
+				label = id
+			}
+			t := hwmonTypes[hwmonInputPattern.FindStringSubmatch(input)[1]]
+			list = append(list, sensor{
+				Name:  entry.Name() + "/" + name + "/" + id,
+				Label: label,
+				Value: float64(value) / t.divisor,
+				Unit:  t.unit,
+			})
+		}
+	}
+	return list, nil
+}
+
+// throttlingFlags reads throttling flags exposed by the Raspberry Pi firmware driver.
+// It returns nil if the board does not expose flags.
+func throttlingFlags(root string) (*throttling, error) {
+	raw, err := os.ReadFile(filepath.Join(root, "devices", "platform", "soc", "soc:firmware", "get_throttled"))
+	if err == nil {
+		value := strings.TrimPrefix(strings.TrimSpace(string(raw)), "0x")
+		flags, err := strconv.ParseUint(value, 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid throttling flags: %s", raw)
+		}
+		return &throttling{
+			Raw:                   fmt.Sprintf("0x%x", flags),
+			UnderVoltage:          flags&(1<<0) != 0,
+			FreqCapped:            flags&(1<<1) != 0,
+			Throttled:             flags&(1<<2) != 0,
+			SoftTempLimit:         flags&(1<<3) != 0,
+			UnderVoltageOccurred:  flags&(1<<16) != 0,
+			FreqCappedOccurred:    flags&(1<<17) != 0,
+			ThrottledOccurred:     flags&(1<<18) != 0,
+			SoftTempLimitOccurred: flags&(1<<19) != 0,
+		}, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	// Fallback to under-voltage alarm of the rpi_volt hwmon
+	dir := filepath.Join(root, "class", "hwmon")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil
+	}
+	for _, entry := range entries {
+		if readString(filepath.Join(dir, entry.Name(), "name")) != "rpi_volt" {
+			continue
+		}
+		alarm, err := readInt(filepath.Join(dir, entry.Name(), "in0_lcrit_alarm"))
+		if err != nil {
+			return nil, err
+		}
+		return &throttling{UnderVoltage: alarm != 0}, nil
+	}
+	return nil, nil
+}
+
+// readInt reads an integer value from the sysfs attribute file.
+func readInt(path string) (int64, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(raw)), 10, 64)
+}
+
+// readString reads a string value from the sysfs attribute file. It returns empty string if not readable.
+func readString(path string) string {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(raw))
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+// writeTree creates files of the fake sysfs tree under the root directory.
+func writeTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestThermalZones(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  []sensor
+	}{
+		{
+			name: "zones",
+			files: map[string]string{
+				"class/thermal/thermal_zone0/temp": "45123\n",
+				"class/thermal/thermal_zone0/type": "cpu-thermal\n",
+				"class/thermal/thermal_zone1/temp": "-5000\n",
+			},
+			want: []sensor{
+				{Name: "thermal_zone0", Label: "cpu-thermal", Value: 45.123, Unit: "°C"},
+				{Name: "thermal_zone1", Label: "", Value: -5, Unit: "°C"},
+			},
+		},
+		{
+			name: "unreadable zone and cooling device",
+			files: map[string]string{
+				"class/thermal/thermal_zone0/temp":    "invalid\n",
+				"class/thermal/cooling_device0/type":  "fan\n",
+				"class/thermal/thermal_zone2/temp":    "30000\n",
+				"class/thermal/thermal_zone2/type":    "gpu-thermal\n",
+				"class/thermal/thermal_zone2/mode":    "enabled\n",
+				"class/thermal/thermal_zone2/policy":  "step_wise\n",
+				"class/thermal/cooling_device0/state": "0\n",
+			},
+			want: []sensor{
+				{Name: "thermal_zone2", Label: "gpu-thermal", Value: 30, Unit: "°C"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			writeTree(t, root, tt.files)
+			got, err := thermalZones(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("thermalZones() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+	if _, err := thermalZones(t.TempDir()); err == nil {
+		t.Error("thermalZones() without thermal class must fail")
+	}
+}
+
+func TestHwmonSensors(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  []sensor
+	}{
+		{
+			name: "all types",
+			files: map[string]string{
+				"class/hwmon/hwmon0/name":         "coretemp\n",
+				"class/hwmon/hwmon0/temp1_input":  "52000\n",
+				"class/hwmon/hwmon0/temp1_label":  "Package id 0\n",
+				"class/hwmon/hwmon0/temp1_max":    "100000\n",
+				"class/hwmon/hwmon0/temp2_input":  "48000\n",
+				"class/hwmon/hwmon1/name":         "ina219\n",
+				"class/hwmon/hwmon1/in0_input":    "5120\n",
+				"class/hwmon/hwmon1/curr1_input":  "750\n",
+				"class/hwmon/hwmon1/power1_input": "3840000\n",
+				"class/hwmon/hwmon1/fan1_input":   "2400\n",
+			},
+			want: []sensor{
+				{Name: "hwmon0/coretemp/temp1", Label: "Package id 0", Value: 52, Unit: "°C"},
+				{Name: "hwmon0/coretemp/temp2", Label: "temp2", Value: 48, Unit: "°C"},
+				{Name: "hwmon1/ina219/curr1", Label: "curr1", Value: 0.75, Unit: "A"},
+				{Name: "hwmon1/ina219/fan1", Label: "fan1", Value: 2400, Unit: "RPM"},
+				{Name: "hwmon1/ina219/in0", Label: "in0", Value: 5.12, Unit: "V"},
+				{Name: "hwmon1/ina219/power1", Label: "power1", Value: 3.84, Unit: "W"},
+			},
+		},
+		{
+			name: "unreadable input",
+			files: map[string]string{
+				"class/hwmon/hwmon0/name":        "nct6775\n",
+				"class/hwmon/hwmon0/fan1_input":  "\n",
+				"class/hwmon/hwmon0/fan2_input":  "900\n",
+				"class/hwmon/hwmon0/fan2_target": "1000\n",
+			},
+			want: []sensor{
+				{Name: "hwmon0/nct6775/fan2", Label: "fan2", Value: 900, Unit: "RPM"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			writeTree(t, root, tt.files)
+			got, err := hwmonSensors(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("hwmonSensors() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSensors(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skipf("unsupported platform: %s", runtime.GOOS)
+	}
+	root := t.TempDir()
+	if _, err := sensors(root); err == nil {
+		t.Error("sensors() without any source must fail")
+	}
+	writeTree(t, root, map[string]string{
+		"class/thermal/thermal_zone0/temp": "40000\n",
+		"class/hwmon/hwmon0/name":          "cpu_thermal\n",
+		"class/hwmon/hwmon0/temp1_input":   "41000\n",
+	})
+	got, err := sensors(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []sensor{
+		{Name: "thermal_zone0", Value: 40, Unit: "°C"},
+		{Name: "hwmon0/cpu_thermal/temp1", Label: "temp1", Value: 41, Unit: "°C"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sensors() = %+v, want %+v", got, want)
+	}
+}
+
+func TestThrottlingFlags(t *testing.T) {
+	const getThrottled = "devices/platform/soc/soc:firmware/get_throttled"
+	tests := []struct {
+		name    string
+		files   map[string]string
+		want    *throttling
+		wantErr bool
+	}{
+		{
+			name:  "no source",
+			files: map[string]string{},
+			want:  nil,
+		},
+		{
+			name:  "not throttled",
+			files: map[string]string{getThrottled: "0\n"},
+			want:  &throttling{Raw: "0x0"},
+		},
+		{
+			name:  "under-voltage now and occurred",
+			files: map[string]string{getThrottled: "50005\n"},
+			want: &throttling{
+				Raw:                  "0x50005",
+				UnderVoltage:         true,
+				Throttled:            true,
+				UnderVoltageOccurred: true,
+				ThrottledOccurred:    true,
+			},
+		},
+		{
+			name:  "all flags with prefix",
+			files: map[string]string{getThrottled: "0xf000f\n"},
+			want: &throttling{
+				Raw:                   "0xf000f",
+				UnderVoltage:          true,
+				FreqCapped:            true,
+				Throttled:             true,
+				SoftTempLimit:         true,
+				UnderVoltageOccurred:  true,
+				FreqCappedOccurred:    true,
+				ThrottledOccurred:     true,
+				SoftTempLimitOccurred: true,
+			},
+		},
+		{
+			name:  "occurred only",
+			files: map[string]string{getThrottled: "a0000\n"},
+			want: &throttling{
+				Raw:                   "0xa0000",
+				FreqCappedOccurred:    true,
+				SoftTempLimitOccurred: true,
+			},
+		},
+		{
+			name:    "invalid flags",
+			files:   map[string]string{getThrottled: "error\n"},
+			wantErr: true,
+		},
+		{
+			name: "rpi_volt alarm",
+			files: map[string]string{
+				"class/hwmon/hwmon0/name":            "cpu_thermal\n",
+				"class/hwmon/hwmon1/name":            "rpi_volt\n",
+				"class/hwmon/hwmon1/in0_lcrit_alarm": "1\n",
+			},
+			want: &throttling{UnderVoltage: true},
+		},
+		{
+			name: "rpi_volt no alarm",
+			files: map[string]string{
+				"class/hwmon/hwmon0/name":            "rpi_volt\n",
+				"class/hwmon/hwmon0/in0_lcrit_alarm": "0\n",
+			},
+			want: &throttling{},
+		},
+		{
+			name: "rpi_volt without alarm",
+			files: map[string]string{
+				"class/hwmon/hwmon0/name": "rpi_volt\n",
+			},
+			wantErr: true,
+		},
+		{
+			name: "other hwmon only",
+			files: map[string]string{
+				"class/hwmon/hwmon0/name":            "cpu_thermal\n",
+				"class/hwmon/hwmon0/in0_lcrit_alarm": "1\n",
+			},
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			writeTree(t, root, tt.files)
+			got, err := throttlingFlags(root)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("throttlingFlags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("throttlingFlags() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const spoolFileExt = ".json"
+
+type spoolEntry struct {
+	path string
+	size int64
+}
+
+// spoolDir returns the spool directory.
+func spoolDir() string {
+	if len(config().SpoolDir) > 0 {
+		return config().SpoolDir
+	}
+	return config().DataPath("spool")
+}
+
+// spoolReport saves the report which failed to upload, then drops oldest entries exceeding the limits.
+func spoolReport(report []byte) error {
+	dir := spoolDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create spool directory: %w", err)
+	}
+	name := filepath.Join(dir, fmt.Sprintf("%020d-%010d%s", time.Now().UnixNano(), seq, spoolFileExt))
+	if err := os.WriteFile(name+".tmp", report, 0600); err != nil {
+		return fmt.Errorf("failed to write spool entry: %w", err)
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return fmt.Errorf("failed to commit spool entry: %w", err)
+	}
+	entries, err := spoolEntries(dir)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, e := range entries {
+		total += e.size
+	}
+	for len(entries) > 0 && (len(entries) > config().SpoolMaxEntries || total > int64(config().SpoolMaxKB)*1024) {
+		log.Printf("spool is full, dropping %s", filepath.Base(entries[0].path))
+		safeRemove(entries[0].path)
+		total -= entries[0].size
+		entries = entries[1:]
+	}
+	return nil
+}
+
+// drainSpool uploads spooled reports oldest-first until the spool is empty or an upload fails.
+// It returns the error of the failed upload.
+func drainSpool() error {
+	entries, err := spoolEntries(spoolDir())
+	if err != nil {
+		log.Printf("failed to scan spool: %v", err)
+		return nil
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	log.Printf("uploading %d spooled reports", len(entries))
+	for _, e := range entries {
+		data, err := os.ReadFile(e.path)
+		if err != nil {
+			log.Printf("failed to read spool entry: %v", err)
+			safeRemove(e.path)
+			continue
+		}
+		if err := upload(data); err != nil {
+			log.Printf("failed to upload spooled report: %v", err)
+			return err
+		}
+		safeRemove(e.path)
+	}
+	return nil
+}
+
+// spoolEntries returns spooled reports sorted by creation time.
+func spoolEntries(dir string) ([]spoolEntry, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read spool directory: %w", err)
+	}
+	var entries []spoolEntry
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), spoolFileExt) {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue // removed while scanning
+		}
+		entries = append(entries, spoolEntry{path: filepath.Join(dir, f.Name()), size: info.Size()})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].path < entries[j].path })
+	return entries, nil
+}
@@ -3,103 +3,418 @@ package main
 import (
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
-var msg reply
+const (
+	primaryForwardName  = "ssh"
+	sshIdleCheckGapSec  = 10
+	sshSwitchCheckGapMs = 500
+	sshDialTimeoutSec   = 30
+	sshKeepaliveRequest = "keepalive@openssh.com"
+	sshStableTime       = time.Minute // Connection lifetime to reset the reconnect backoff
+)
+
+// SSH tunnel states reported by ssh_tunnel_state.
+const (
+	sshStateDisabled   = "disabled"    // SSH disabled by the configuration
+	sshStateClosed     = "closed"      // Tunnel not wanted by the server
+	sshStateIdleClosed = "idle_closed" // Tunnel closed by the idle timeout
+	sshStateConnecting = "connecting"  // Tunnel wanted but not connected
+	sshStateOpen       = "open"        // Tunnel connected
+)
+
+// sshForward defines a local endpoint forwarded from a remote port of the SSH server.
+type sshForward struct {
+	Name string `json:"name"`
+	Host string `json:"host"`
+	Port int    `json:"port"`
+}
+
+var (
+	msg            reply // Last reply with SSH server information, guarded by sshMutex
+	sshClient      *ssh.Client
+	sshRemotePorts map[string]int // Allocated remote ports by forward names, guarded by sshMutex
+	sshRemotePort  int            // Allocated remote port of the primary forward, guarded by sshMutex
+	sshConnectTime time.Time      // Time of the current connection established, guarded by sshMutex
+	sshMutex       sync.Mutex
+	sshWakeup      = make(chan struct{}, 1)
+	sshWanted      = true       // Tunnel wanted by the server (always wanted if the server does not specify)
+	sshOnDemand    = false      // Server controls the tunnel lifecycle by ssh_wanted
+	sshIdleClosed  = false      // Tunnel closed by the idle timeout, until the server withdraws the request
+	sshKeepaliveMs atomic.Int64 // Round trip time of the last keepalive request
+)
 
 func listenSSH() {
+	var retry backoff
 	for {
+		if !config().SSHEnabled || !tunnelWanted() {
+			<-sshWakeup
+			continue
+		}
 		if err := openTunnel(); err != nil {
+			sshKeepaliveMs.Store(0)
+			sshMutex.Lock()
+			if !sshConnectTime.IsZero() && time.Since(sshConnectTime) > sshStableTime {
+				retry.reset()
+			}
+			sshRemotePorts = nil
 			sshRemotePort = 0
 			sshConnectTime = time.Time{}
-			log.Printf("ssh connection failed: %v, restarting...", err)
-			time.Sleep(time.Duration(config.SSHRetryGapSec) * time.Second)
+			sshMutex.Unlock()
+			if !tunnelWanted() {
+				log.Print("ssh tunnel closed")
+				continue
+			}
+			delay := retry.retryDelay(config().SSHRetryGapSec, config().SSHRetryMaxSec)
+			log.Printf("ssh connection failed: %v, restarting after %v...", err, delay.Round(time.Second))
+			select {
+			case <-time.After(delay):
+			case <-sshWakeup: // restarted by configuration or server change
+			}
 		}
 	}
 }
 
 func openTunnel() error {
-	if len(msg.SSHServerHost) == 0 {
+	r := sshReply()
+	if len(r.SSHServerHost) == 0 {
 		return errors.New("ssh information is empty")
 	}
+	hostKey, err := hostKeyCallback(r)
+	if err != nil {
+		return err
+	}
 	sshConfig := &ssh.ClientConfig{
-		User:            msg.SSHServerUser,
+		User:            r.SSHServerUser,
 		Auth:            make([]ssh.AuthMethod, 0),
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		HostKeyCallback: hostKey,
+		Timeout:         sshDialTimeoutSec * time.Second,
 	}
-	if len(msg.SSHKey) > 0 {
-		key, err := ssh.ParsePrivateKey([]byte(msg.SSHKey))
+	if len(r.SSHKey) > 0 {
+		key, err := ssh.ParsePrivateKey([]byte(r.SSHKey))
 		if err != nil {
 			return fmt.Errorf("failed to parase key: %w", err)
 		}
 		sshConfig.Auth = append(sshConfig.Auth, ssh.PublicKeys(key))
 	}
-	if len(msg.SSHPassword) > 0 {
-		sshConfig.Auth = append(sshConfig.Auth, ssh.Password(msg.SSHPassword))
+	if len(r.SSHPassword) > 0 {
+		sshConfig.Auth = append(sshConfig.Auth, ssh.Password(r.SSHPassword))
 	}
 
 	// Connect to the server
-	serverConn, err := ssh.Dial("tcp", msg.SSHServer(), sshConfig)
+	serverConn, err := ssh.Dial("tcp", r.SSHServer(), sshConfig)
 	if err != nil {
-		return fmt.Errorf("failed to connect remote ssh server %s: %w", msg.SSHServer(), err)
+		return fmt.Errorf("failed to connect remote ssh server %s: %w", r.SSHServer(), err)
 	}
+	sshConnections.Add(1)
+	sshMutex.Lock()
+	sshClient = serverConn
+	sshMutex.Unlock()
+	defer func() {
+		sshMutex.Lock()
+		sshClient = nil
+		sshMutex.Unlock()
+		safeClose(serverConn, "ssh connection")
+	}()
 
-	// Open a remote socket
-	listener, err := serverConn.Listen("tcp", fmt.Sprintf("%s:%d", "localhost", 0))
-	if err != nil {
-		return fmt.Errorf("failed to open remote socket: %w", err)
+	// Open remote sockets
+	errCh := make(chan error, 1)
+	ports := make(map[string]int)
+	for _, forward := range forwards(r) {
+		listener, err := serverConn.Listen("tcp", fmt.Sprintf("%s:%d", "localhost", 0))
+		if err != nil {
+			if forward.Name == primaryForwardName {
+				return fmt.Errorf("failed to open remote socket: %w", err)
+			}
+			deferError("failed to open remote socket for %s: %v", forward.Name, err)
+			continue
+		}
+		defer safeClose(listener, "remote socket listener")
+		ports[forward.Name] = port(listener.Addr())
+		log.Printf("ssh listener open: %s -> %s (%s)", listener.Addr().String(), forward.Local(), forward.Name)
+		go func(listener net.Listener, forward sshForward) {
+			select {
+			case errCh <- serveForward(listener, forward):
+			default:
+			}
+		}(listener, forward)
 	}
-	defer safeClose(listener, "remote socket listener")
-	sshRemotePort = port(listener.Addr())
+	sshMutex.Lock()
+	sshRemotePorts = ports
+	sshRemotePort = ports[primaryForwardName]
 	sshConnectTime = time.Now().UTC()
-	log.Printf("ssh listener open: %s", listener.Addr().String())
-	go doReport(-1)
+	sshMutex.Unlock()
+	go doReport(triggerConnected)
+	done := make(chan struct{})
+	defer close(done)
+	go watchIdleTunnel(serverConn, done)
+	go keepAlive(serverConn, done)
+	return <-errCh
+}
 
-	// Open a local socket
+// keepAlive sends keepalive requests periodically, and closes the connection if requests failed continuously.
+func keepAlive(conn *ssh.Client, done chan struct{}) {
+	if config().SSHKeepaliveSec <= 0 {
+		return
+	}
+	interval := time.Duration(config().SSHKeepaliveSec) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	failures := 0
 	for {
-		local, err := net.Dial("tcp", config.SSHLocal())
-		if err != nil {
-			return fmt.Errorf("failed to connect local socket: %s", err)
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
 		}
-		client, err := listener.Accept()
-		if err != nil {
-			return fmt.Errorf("failed to listen local socket: %w", err)
+		begin := time.Now()
+		result := make(chan error, 1)
+		go func() {
+			_, _, err := conn.SendRequest(sshKeepaliveRequest, true, nil) // any reply means alive
+			result <- err
+		}()
+		var err error
+		select {
+		case err = <-result:
+		case <-time.After(interval):
+			err = errors.New("timeout")
+		case <-done:
+			return
+		}
+		if err == nil {
+			sshKeepaliveMs.Store(time.Since(begin).Milliseconds())
+			failures = 0
+			continue
+		}
+		failures++
+		log.Printf("ssh keepalive failed (%d/%d): %v", failures, config().SSHKeepaliveMax, err)
+		if failures >= config().SSHKeepaliveMax {
+			log.Print("ssh connection is dead, reconnecting")
+			safeClose(conn, "ssh connection")
+			return
+		}
+	}
+}
+
+// setSSHReply updates the SSH server information by the reply.
+// The tunnel is reconnected if the connection parameters are changed, after active clients are disconnected
+// or the grace period is elapsed. If not connected, the retry loop is woken up to dial the new server immediately. Replies without SSH server host (ex. partial replies) are ignored.
+func setSSHReply(r reply) {
+	if len(r.SSHServerHost) == 0 {
+		return
+	}
+	sshMutex.Lock()
+	changed := sshParamsChanged(msg, r)
+	first := len(msg.SSHServerHost) == 0
+	msg = r
+	connected := sshClient != nil
+	sshMutex.Unlock()
+	switch {
+	case changed && connected && !first:
+		log.Printf("ssh parameters changed, moving to %s", r.SSHServer())
+		go switchSSH()
+	case changed && !connected:
+		select {
+		case sshWakeup <- struct{}{}: // dial the new server without waiting for the retry backoff
+		default:
 		}
-		go handleClient(client, local)
 	}
 }
 
-// handleClient handles local socket from the tunnel.
-func handleClient(client net.Conn, remote net.Conn) {
-	defer safeClose(client, "client")
-	chDone := make(chan bool)
+// sshReply returns the last reply with SSH server information.
+func sshReply() reply {
+	sshMutex.Lock()
+	defer sshMutex.Unlock()
+	return msg
+}
 
-	// Start remote -> local data transfer
-	go func() {
-		_, err := io.Copy(client, remote)
-		if err != nil {
-			log.Printf("error while copy remote->local: %s", err)
+// sshParamsChanged reports whether the SSH connection parameters of the replies are different.
+func sshParamsChanged(a, b reply) bool {
+	return a.SSHServerHost != b.SSHServerHost ||
+		a.SSHServerPort != b.SSHServerPort ||
+		a.SSHServerUser != b.SSHServerUser ||
+		a.SSHKey != b.SSHKey ||
+		a.SSHPassword != b.SSHPassword ||
+		a.SSHHostKey != b.SSHHostKey ||
+		!reflect.DeepEqual(a.SSHForwards, b.SSHForwards)
+}
+
+// switchSSH waits for active clients to disconnect up to the grace period, then reconnects the tunnel.
+func switchSSH() {
+	deadline := time.Now().Add(time.Duration(config().SSHSwitchGraceSec) * time.Second)
+	for activeTunnelConns() > 0 && time.Now().Before(deadline) {
+		time.Sleep(sshSwitchCheckGapMs * time.Millisecond)
+	}
+	if n := activeTunnelConns(); n > 0 {
+		log.Printf("closing %d active ssh tunnel connections to move ssh server", n)
+	}
+	restartSSH()
+}
+
+// watchIdleTunnel closes the on-demand tunnel if no client connected for the idle timeout.
+func watchIdleTunnel(conn *ssh.Client, done chan struct{}) {
+	ticker := time.NewTicker(sshIdleCheckGapSec * time.Second)
+	defer ticker.Stop()
+	lastActive := time.Now()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
 		}
-		chDone <- true
-	}()
+		if activeTunnelConns() > 0 {
+			lastActive = time.Now()
+			continue
+		}
+		timeout := time.Duration(config().SSHIdleTimeoutMin) * time.Minute
+		sshMutex.Lock()
+		idle := sshOnDemand && timeout > 0 && time.Since(lastActive) >= timeout
+		if idle {
+			sshWanted = false
+			sshIdleClosed = true
+		}
+		sshMutex.Unlock()
+		if idle {
+			log.Printf("ssh tunnel idle for %v, closing", timeout)
+			safeClose(conn, "ssh connection")
+			return
+		}
+	}
+}
 
-	// Start local -> remote data transfer
-	go func() {
-		_, err := io.Copy(remote, client)
+// setTunnelWanted opens or closes the tunnel by the request of the server.
+// A request to open is ignored after the idle timeout until the server withdraws the request.
+func setTunnelWanted(wanted bool) {
+	sshMutex.Lock()
+	sshOnDemand = true
+	if !wanted {
+		sshIdleClosed = false
+	}
+	changed := sshWanted != wanted && !(wanted && sshIdleClosed)
+	if changed {
+		sshWanted = wanted
+	}
+	client := sshClient
+	sshMutex.Unlock()
+	if !changed {
+		return
+	}
+	if wanted {
+		log.Print("ssh tunnel requested by the server")
+	} else {
+		log.Print("ssh tunnel withdrawn by the server")
+		if client != nil {
+			safeClose(client, "ssh connection")
+		}
+	}
+	select {
+	case sshWakeup <- struct{}{}:
+	default:
+	}
+}
+
+// tunnelWanted reports whether the tunnel should be connected.
+func tunnelWanted() bool {
+	sshMutex.Lock()
+	defer sshMutex.Unlock()
+	return sshWanted
+}
+
+// tunnelState returns the current state of the SSH tunnel.
+func tunnelState() string {
+	sshMutex.Lock()
+	defer sshMutex.Unlock()
+	switch {
+	case !config().SSHEnabled:
+		return sshStateDisabled
+	case sshIdleClosed:
+		return sshStateIdleClosed
+	case !sshWanted:
+		return sshStateClosed
+	case sshClient != nil && len(sshRemotePorts) > 0:
+		return sshStateOpen
+	default:
+		return sshStateConnecting
+	}
+}
+
+// serveForward connects clients of the remote socket to the local endpoint.
+func serveForward(listener net.Listener, forward sshForward) error {
+	for {
+		client, err := listener.Accept()
 		if err != nil {
-			log.Printf("error while copy local->remote: %s", err)
+			return fmt.Errorf("failed to accept remote socket: %w", err)
 		}
-		chDone <- true
-	}()
-	<-chDone
+		go handleClient(client, forward)
+	}
+}
+
+// forwards returns the primary SSH forward followed by forwards of the configuration and the reply.
+// A forward of the reply overrides the forward with the same name.
+func forwards(r reply) []sshForward {
+	list := []sshForward{{Name: primaryForwardName, Host: config().SSHLocalHost, Port: config().SSHLocalPort}}
+	for _, forward := range append(append([]sshForward{}, config().SSHForwards...), r.SSHForwards...) {
+		replaced := false
+		for i := range list {
+			if list[i].Name == forward.Name {
+				list[i] = forward
+				replaced = true
+			}
+		}
+		if !replaced {
+			list = append(list, forward)
+		}
+	}
+	return list
+}
+
+// remotePorts returns allocated remote ports by forward names.
+func remotePorts() map[string]int {
+	sshMutex.Lock()
+	defer sshMutex.Unlock()
+	if len(sshRemotePorts) == 0 {
+		return nil
+	}
+	ports := make(map[string]int, len(sshRemotePorts))
+	for name, p := range sshRemotePorts {
+		ports[name] = p
+	}
+	return ports
+}
+
+// sshConnection returns the established time and the remote port of the primary forward of the current connection.
+func sshConnection() (time.Time, int) {
+	sshMutex.Lock()
+	defer sshMutex.Unlock()
+	return sshConnectTime, sshRemotePort
+}
+
+// restartSSH disconnects the current SSH connection to reconnect with the latest configuration.
+func restartSSH() {
+	sshMutex.Lock()
+	defer sshMutex.Unlock()
+	if sshClient != nil {
+		safeClose(sshClient, "ssh connection")
+	}
+	select {
+	case sshWakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Local returns local host and port with colon separator.
+func (f sshForward) Local() string {
+	return fmt.Sprintf("%s:%d", f.Host, f.Port)
 }
 
 func port(addr net.Addr) int {
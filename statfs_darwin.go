@@ -0,0 +1,8 @@
+package main
+
+import "syscall"
+
+// statfsBlockSize returns the unit of block counts, which is the fundamental block size on macOS.
+func statfsBlockSize(st *syscall.Statfs_t) int64 {
+	return int64(st.Bsize)
+}
@@ -0,0 +1,11 @@
+package main
+
+import "syscall"
+
+// statfsBlockSize returns the unit of block counts, which is the fragment size on Linux as same as df.
+func statfsBlockSize(st *syscall.Statfs_t) int64 {
+	if st.Frsize > 0 {
+		return int64(st.Frsize)
+	}
+	return int64(st.Bsize)
+}
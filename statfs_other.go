@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// statfs obtains usages of the filesystem containing the path.
+func statfs(string) (*fsStat, error) {
+	return nil, fmt.Errorf("unsupported platform: %s", runtime.GOOS)
+}
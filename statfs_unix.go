@@ -0,0 +1,24 @@
+//go:build linux || darwin
+
+package main
+
+import "syscall"
+
+const statfsReadOnly = 0x1 // ST_RDONLY of Linux and MNT_RDONLY of macOS
+
+// statfs obtains usages of the filesystem containing the path.
+func statfs(path string) (*fsStat, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return nil, err
+	}
+	blockSize := statfsBlockSize(&st)
+	used := (int64(st.Blocks) - int64(st.Bfree)) * blockSize
+	return &fsStat{
+		totalBytes:  used + int64(st.Bavail)*blockSize,
+		usedBytes:   used,
+		inodesTotal: int64(st.Files),
+		inodesUsed:  int64(st.Files) - int64(st.Ffree),
+		readOnly:    int64(st.Flags)&statfsReadOnly != 0,
+	}, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	procRoot           = "/proc"
+	cpuSampleGapMillis = 500
+)
+
+type systemMetricsReport struct {
+	CPUUsagePercent float64
+	MemTotalBytes   int64
+	MemUsedBytes    int64
+	SwapTotalBytes  int64
+	SwapUsedBytes   int64
+	LoadAverage1    float64
+	LoadAverage5    float64
+	LoadAverage15   float64
+	UptimeSec       int64
+}
+
+type cpuSample struct {
+	total int64
+	idle  int64
+}
+
+var lastCPUSample *cpuSample
+
+// systemMetrics collects CPU, memory, load average and uptime from the proc filesystem.
+// Each source is collected independently, and errors of missing sources are returned.
+func systemMetrics(root string) (*systemMetricsReport, []error) {
+	if runtime.GOOS != "linux" {
+		return nil, []error{fmt.Errorf("unsupported platform: %s", runtime.GOOS)}
+	}
+	var rep systemMetricsReport
+	var errs []error
+	if usage, err := cpuUsage(root); err != nil {
+		errs = append(errs, fmt.Errorf("cpu usage: %w", err))
+	} else {
+		rep.CPUUsagePercent = usage
+	}
+	if mem, err := readKeyValues(filepath.Join(root, "meminfo")); err != nil {
+		errs = append(errs, fmt.Errorf("memory usage: %w", err))
+	} else if _, ok := mem["MemTotal"]; !ok {
+		errs = append(errs, errors.New("memory usage: no MemTotal in meminfo"))
+	} else {
+		available, ok := mem["MemAvailable"]
+		if !ok {
+			available = mem["MemFree"] + mem["Buffers"] + mem["Cached"] // kernel older than 3.14
+		}
+		rep.MemTotalBytes = mem["MemTotal"] * 1024
+		rep.MemUsedBytes = (mem["MemTotal"] - available) * 1024
+		rep.SwapTotalBytes = mem["SwapTotal"] * 1024
+		rep.SwapUsedBytes = (mem["SwapTotal"] - mem["SwapFree"]) * 1024
+	}
+	if fields, err := readFields(filepath.Join(root, "loadavg"), 3); err != nil {
+		errs = append(errs, fmt.Errorf("load average: %w", err))
+	} else {
+		rep.LoadAverage1, _ = strconv.ParseFloat(fields[0], 64)
+		rep.LoadAverage5, _ = strconv.ParseFloat(fields[1], 64)
+		rep.LoadAverage15, _ = strconv.ParseFloat(fields[2], 64)
+	}
+	if fields, err := readFields(filepath.Join(root, "uptime"), 1); err != nil {
+		errs = append(errs, fmt.Errorf("uptime: %w", err))
+	} else {
+		uptime, _ := strconv.ParseFloat(fields[0], 64)
+		rep.UptimeSec = int64(uptime)
+	}
+	return &rep, errs
+}
+
+// cpuUsage returns CPU usage percent since the last call.
+// The first call measures the usage in a short period.
+func cpuUsage(root string) (float64, error) {
+	prev := lastCPUSample
+	if prev == nil {
+		sample, err := readCPUSample(root)
+		if err != nil {
+			return 0, err
+		}
+		prev = sample
+		time.Sleep(cpuSampleGapMillis * time.Millisecond)
+	}
+	current, err := readCPUSample(root)
+	if err != nil {
+		return 0, err
+	}
+	lastCPUSample = current
+	total := current.total - prev.total
+	if total <= 0 {
+		return 0, nil
+	}
+	return float64(total-(current.idle-prev.idle)) * 100 / float64(total), nil
+}
+
+// readCPUSample reads the aggregated CPU times from the first line of the stat file.
+func readCPUSample(root string) (*cpuSample, error) {
+	raw, err := os.ReadFile(filepath.Join(root, "stat"))
+	if err != nil {
+		return nil, err
+	}
+	line, _, _ := bytes.Cut(raw, []byte("\n"))
+	fields := strings.Fields(string(line))
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return nil, fmt.Errorf("invalid record: %s", line)
+	}
+	var sample cpuSample
+	for i, field := range fields[1:] {
+		if i >= 8 {
+			break // guest times are already included in user times
+		}
+		v, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid record: %s", line)
+		}
+		sample.total += v
+		if i == 3 || i == 4 {
+			sample.idle += v // idle and iowait
+		}
+	}
+	return &sample, nil
+}
+
+// readKeyValues reads "key: value [unit]" formatted file such as meminfo.
+func readKeyValues(path string) (map[string]int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer safeClose(f, path)
+	values := make(map[string]int64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), ":")
+		if !found {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+		if v, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+			values[key] = v
+		}
+	}
+	return values, scanner.Err()
+}
+
+// readFields reads whitespace separated fields of the file, at least n fields are required.
+func readFields(path string, n int) ([]string, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(raw))
+	if len(fields) < n {
+		return nil, fmt.Errorf("invalid record: %s", raw)
+	}
+	return fields, nil
+}
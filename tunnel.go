@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// tunnelStats defines connection statistics of a forward since the process start.
+type tunnelStats struct {
+	ActiveConns     int   `json:"active_conns"`                // Number of active connections
+	TotalConns      int   `json:"total_conns"`                 // Number of accepted connections
+	FailedConns     int   `json:"failed_conns,omitempty"`      // Number of connections failed to connect local endpoint
+	BytesIn         int64 `json:"bytes_in"`                    // Transferred bytes from remote to local
+	BytesOut        int64 `json:"bytes_out"`                   // Transferred bytes from local to remote
+	LastSessionSec  int64 `json:"last_session_sec,omitempty"`  // Length of the last closed connection
+	TotalSessionSec int64 `json:"total_session_sec,omitempty"` // Total length of closed connections
+}
+
+// countingWriter counts written bytes into the tunnel statistics.
+type countingWriter struct {
+	w       io.Writer
+	name    string
+	inbound bool
+}
+
+var (
+	tunnelStatsMap   = make(map[string]*tunnelStats)
+	tunnelStatsMutex sync.Mutex
+)
+
+// handleClient connects the client of the remote socket to the local endpoint, and transfers data in both directions.
+// The local endpoint is connected when the client connected, and both connections are closed after both directions end.
+func handleClient(client net.Conn, forward sshForward) {
+	local, err := net.Dial("tcp", forward.Local())
+	if err != nil {
+		log.Printf("failed to connect local socket %s: %v", forward.Local(), err)
+		updateTunnelStats(forward.Name, func(s *tunnelStats) { s.TotalConns++; s.FailedConns++ })
+		safeClose(client, "client")
+		return
+	}
+	var closeOnce sync.Once
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			safeClose(client, "client")
+			safeClose(local, "local socket")
+		})
+	}
+	defer closeBoth()
+	updateTunnelStats(forward.Name, func(s *tunnelStats) { s.TotalConns++; s.ActiveConns++ })
+	begin := time.Now()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	transfer := func(dst, src net.Conn, inbound bool) {
+		defer wg.Done()
+		if _, err := io.Copy(&countingWriter{w: dst, name: forward.Name, inbound: inbound}, src); err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("error while transfer (%s): %v", forward.Name, err)
+			}
+			closeBoth() // abort the other direction
+			return
+		}
+		if !closeWrite(dst) {
+			closeBoth() // no way to propagate EOF to the other side
+		}
+	}
+	go transfer(local, client, true)
+	go transfer(client, local, false)
+	wg.Wait()
+
+	elapsed := int64(time.Since(begin).Seconds())
+	updateTunnelStats(forward.Name, func(s *tunnelStats) {
+		s.ActiveConns--
+		s.LastSessionSec = elapsed
+		s.TotalSessionSec += elapsed
+	})
+}
+
+// closeWrite shuts down the writing side of the connection if supported.
+func closeWrite(conn net.Conn) bool {
+	c, ok := conn.(interface{ CloseWrite() error })
+	return ok && c.CloseWrite() == nil
+}
+
+// activeTunnelConns returns the number of active connections of all forwards.
+func activeTunnelConns() int {
+	tunnelStatsMutex.Lock()
+	defer tunnelStatsMutex.Unlock()
+	n := 0
+	for _, stats := range tunnelStatsMap {
+		n += stats.ActiveConns
+	}
+	return n
+}
+
+// updateTunnelStats updates the tunnel statistics of the forward.
+func updateTunnelStats(name string, update func(s *tunnelStats)) {
+	tunnelStatsMutex.Lock()
+	defer tunnelStatsMutex.Unlock()
+	stats, ok := tunnelStatsMap[name]
+	if !ok {
+		stats = &tunnelStats{}
+		tunnelStatsMap[name] = stats
+	}
+	update(stats)
+}
+
+// tunnelStatsSnapshot returns copy of the tunnel statistics by forward names.
+func tunnelStatsSnapshot() map[string]tunnelStats {
+	tunnelStatsMutex.Lock()
+	defer tunnelStatsMutex.Unlock()
+	if len(tunnelStatsMap) == 0 {
+		return nil
+	}
+	snapshot := make(map[string]tunnelStats, len(tunnelStatsMap))
+	for name, stats := range tunnelStatsMap {
+		snapshot[name] = *stats
+	}
+	return snapshot
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	updateTunnelStats(w.name, func(s *tunnelStats) {
+		if w.inbound {
+			s.BytesIn += int64(n)
+		} else {
+			s.BytesOut += int64(n)
+		}
+	})
+	return n, err
+}
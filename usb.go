@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// usbSysfsDevices lists USB devices from /sys/bus/usb/devices of the sysfs.
+// Interface entries (ex. 1-1.2:1.0) are skipped.
+func usbSysfsDevices(root string) ([]usbDevice, error) {
+	dir := filepath.Join(root, "bus", "usb", "devices")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var devices []usbDevice
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), ":") {
+			continue
+		}
+		deviceDir := filepath.Join(dir, entry.Name())
+		vendorID := readString(filepath.Join(deviceDir, "idVendor"))
+		productID := readString(filepath.Join(deviceDir, "idProduct"))
+		if len(vendorID) == 0 || len(productID) == 0 {
+			continue
+		}
+		device := usbDevice{
+			VendorID:     vendorID,
+			ProductID:    productID,
+			Manufacturer: readString(filepath.Join(deviceDir, "manufacturer")),
+			Product:      readString(filepath.Join(deviceDir, "product")),
+			Serial:       readString(filepath.Join(deviceDir, "serial")),
+			PortPath:     readString(filepath.Join(deviceDir, "devpath")),
+			Class:        readString(filepath.Join(deviceDir, "bDeviceClass")),
+		}
+		device.Name = strings.TrimSpace(device.Manufacturer + " " + device.Product)
+		if bus, err := readInt(filepath.Join(deviceDir, "busnum")); err == nil {
+			device.Bus = int(bus)
+			if num, err := readInt(filepath.Join(deviceDir, "devnum")); err == nil {
+				device.Location = fmt.Sprintf("Bus %03d Device %03d", bus, num)
+			}
+		}
+		if speed, err := strconv.ParseFloat(readString(filepath.Join(deviceDir, "speed")), 64); err == nil {
+			device.SpeedMbps = speed
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUSBSysfsDevices(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  []usbDevice
+	}{
+		{
+			name: "device with all attributes",
+			files: map[string]string{
+				"bus/usb/devices/1-1.2/idVendor":     "0403\n",
+				"bus/usb/devices/1-1.2/idProduct":    "6001\n",
+				"bus/usb/devices/1-1.2/manufacturer": "FTDI\n",
+				"bus/usb/devices/1-1.2/product":      "FT232R USB UART\n",
+				"bus/usb/devices/1-1.2/serial":       "A50285BI\n",
+				"bus/usb/devices/1-1.2/devpath":      "1.2\n",
+				"bus/usb/devices/1-1.2/bDeviceClass": "00\n",
+				"bus/usb/devices/1-1.2/busnum":       "1\n",
+				"bus/usb/devices/1-1.2/devnum":       "5\n",
+				"bus/usb/devices/1-1.2/speed":        "12\n",
+			},
+			want: []usbDevice{{
+				Name:         "FTDI FT232R USB UART",
+				VendorID:     "0403",
+				ProductID:    "6001",
+				Location:     "Bus 001 Device 005",
+				Manufacturer: "FTDI",
+				Product:      "FT232R USB UART",
+				Serial:       "A50285BI",
+				Bus:          1,
+				PortPath:     "1.2",
+				SpeedMbps:    12,
+				Class:        "00",
+			}},
+		},
+		{
+			name: "interface entries are skipped",
+			files: map[string]string{
+				"bus/usb/devices/usb1/idVendor":      "1d6b\n",
+				"bus/usb/devices/usb1/idProduct":     "0002\n",
+				"bus/usb/devices/usb1/bDeviceClass":  "09\n",
+				"bus/usb/devices/usb1/speed":         "480\n",
+				"bus/usb/devices/1-0:1.0/idVendor":   "1d6b\n",
+				"bus/usb/devices/1-0:1.0/idProduct":  "0002\n",
+				"bus/usb/devices/1-1:1.0/idVendor":   "0403\n",
+				"bus/usb/devices/1-1:1.0/idProduct":  "6001\n",
+				"bus/usb/devices/1-1:1.0/bInterface": "00\n",
+			},
+			want: []usbDevice{{
+				VendorID:  "1d6b",
+				ProductID: "0002",
+				SpeedMbps: 480,
+				Class:     "09",
+			}},
+		},
+		{
+			name: "missing idVendor or idProduct",
+			files: map[string]string{
+				"bus/usb/devices/1-1/idProduct": "6001\n",
+				"bus/usb/devices/1-1/product":   "No vendor\n",
+				"bus/usb/devices/1-2/idVendor":  "0403\n",
+				"bus/usb/devices/1-2/product":   "No product\n",
+				"bus/usb/devices/1-3/idVendor":  "\n",
+				"bus/usb/devices/1-3/idProduct": "6001\n",
+			},
+			want: nil,
+		},
+		{
+			name: "bus without devnum",
+			files: map[string]string{
+				"bus/usb/devices/2-1/idVendor":  "0bda\n",
+				"bus/usb/devices/2-1/idProduct": "8153\n",
+				"bus/usb/devices/2-1/busnum":    "2\n",
+				"bus/usb/devices/2-1/speed":     "5000\n",
+			},
+			want: []usbDevice{{
+				VendorID:  "0bda",
+				ProductID: "8153",
+				Bus:       2,
+				SpeedMbps: 5000,
+			}},
+		},
+		{
+			name: "fractional and unknown speed",
+			files: map[string]string{
+				"bus/usb/devices/3-1/idVendor":     "046d\n",
+				"bus/usb/devices/3-1/idProduct":    "c52b\n",
+				"bus/usb/devices/3-1/speed":        "1.5\n",
+				"bus/usb/devices/3-1/bDeviceClass": "ff\n",
+				"bus/usb/devices/3-2/idVendor":     "046d\n",
+				"bus/usb/devices/3-2/idProduct":    "c534\n",
+				"bus/usb/devices/3-2/speed":        "unknown\n",
+			},
+			want: []usbDevice{
+				{VendorID: "046d", ProductID: "c52b", SpeedMbps: 1.5, Class: "ff"},
+				{VendorID: "046d", ProductID: "c534"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			writeTree(t, root, tt.files)
+			got, err := usbSysfsDevices(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("usbSysfsDevices() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+	if _, err := usbSysfsDevices(t.TempDir()); err == nil {
+		t.Error("usbSysfsDevices() without usb bus must fail")
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"archive/zip"
 	"bytes"
 	"compress/bzip2"
+	"crypto/ed25519"
 	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
@@ -14,65 +16,135 @@ import (
 	"os/exec"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 )
 
-func updateChecker() {
-	if checkAndUpdate() {
+const updateCheckGap = 24 * time.Hour
+
+var (
+	updateCheckerStop  chan struct{}
+	updateCheckerMutex sync.Mutex
+	updateMutex        sync.Mutex // Serializes updates by the update checker and the control channel
+	updateInstalled    bool       // New binary is installed and waiting for restart, guarded by updateMutex
+	noUpdateKeysLogged bool       // Absence of trusted keys has been logged, guarded by updateMutex
+)
+
+// startUpdateChecker starts the update checker if not started.
+func startUpdateChecker() {
+	updateCheckerMutex.Lock()
+	defer updateCheckerMutex.Unlock()
+	if updateCheckerStop != nil {
+		return
+	}
+	updateCheckerStop = make(chan struct{})
+	go updateChecker(updateCheckerStop)
+}
+
+// stopUpdateChecker stops the running update checker.
+func stopUpdateChecker() {
+	updateCheckerMutex.Lock()
+	defer updateCheckerMutex.Unlock()
+	if updateCheckerStop == nil {
 		return
 	}
-	for range time.Tick(24 * time.Hour) {
-		if checkAndUpdate() {
+	close(updateCheckerStop)
+	updateCheckerStop = nil
+}
+
+// updateChecker checks update daily, or retries with backoff if the update failed.
+func updateChecker(stop chan struct{}) {
+	var retry backoff
+	for {
+		finished, err := checkAndUpdate()
+		if finished {
 			return
 		}
+		delay := updateCheckGap
+		if err != nil {
+			delay = retry.retryDelay(config().UpdateRetryMinSec, config().UpdateRetryMaxSec)
+			log.Printf("%v, retrying after %v...", err, delay.Round(time.Second))
+		} else {
+			retry.reset()
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+		}
 	}
 }
 
-func checkAndUpdate() (finished bool) {
+func checkAndUpdate() (finished bool, err error) {
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+	if updateInstalled {
+		return true, nil // replacing again overwrites the rollback target
+	}
+	if len(trustedUpdateKeys()) == 0 {
+		if !noUpdateKeysLogged {
+			log.Print("automatic update paused until trusted update keys are configured")
+			noUpdateKeysLogged = true
+		}
+		return false, nil // checked again on the daily schedule or by reloading the configuration
+	}
+	noUpdateKeysLogged = false
 	newVer, newest := latest()
+	recordUpdateCheck(newVer)
 	if newest {
-		return false
+		return false, nil
+	}
+	if failedVersion() == newVer {
+		return false, nil // rolled back from this version
 	}
 	log.Printf("starting version up process: %s -> %s", ver, newVer)
+	updateAttempts.Add(1)
 	url := binaryURL()
 	if len(url) == 0 {
 		log.Printf("automatic update disabled due to unsupported machine: %s %s", runtime.GOOS, runtime.GOARCH)
-		return true
+		return true, nil
 	}
 	archive, err := download(url)
 	if err != nil {
-		log.Printf("failed to download version %s: %v", newVer, err)
-		return false
+		return false, fmt.Errorf("failed to download version %s: %w", newVer, err)
 	}
 	checksum, err := download(url + ".sha256")
 	if err != nil {
-		log.Printf("failed to download checksum: %v", err)
-		return false
+		return false, fmt.Errorf("failed to download checksum: %w", err)
 	}
 	if !validate(archive, checksum) {
-		log.Print("checksum error")
-		return false
+		return false, errors.New("checksum error")
+	}
+	signature, err := download(url + ".sig")
+	if err != nil {
+		return false, fmt.Errorf("failed to download signature: %w", err)
+	}
+	if err := verifySignature(archive, signature); err != nil {
+		return false, fmt.Errorf("signature error: %w", err)
 	}
 	tempFileName, err := extract(archive)
 	if err != nil {
-		log.Printf("failed to extract version %s: %v", newVer, err)
-		return false
+		return false, fmt.Errorf("failed to extract version %s: %w", newVer, err)
 	}
 	if err := replace(tempFileName); err != nil {
 		log.Printf("automatic update disabled due to binary replacement failed: %v", err)
-		return true
+		return true, nil
 	}
-	if len(config.UpdateCommand) > 0 {
+	updateInstalled = true
+	if err := beginProbation(newVer); err != nil {
+		log.Printf("failed to begin probation of version %s: %v", newVer, err)
+	}
+	if len(config().UpdateCommand) > 0 {
 		log.Print("download complete. now executing restart...")
 		restart()
-		return true
+		return true, nil
 	}
 	log.Printf("download complete. please restart process manually.")
-	return true
+	return true, nil
 }
 
 func latest() (string, bool) {
-	resp, err := http.Get(config.UpdateCheckURL)
+	resp, err := http.Get(config().UpdateCheckURL)
 	if err != nil {
 		return ver, true // may offline
 	}
@@ -82,43 +154,47 @@ func latest() (string, bool) {
 		return ver, true
 	}
 	latest := strings.TrimSpace(string(body))
-	currentVer := ver
+	return latest, releaseVersion() == latest
+}
+
+// releaseVersion returns the running version without commit number (ex. v0.0.1-18-g2c63e8b -> v0.0.1).
+func releaseVersion() string {
 	i := strings.Index(ver, "-")
 	if i > 0 {
-		currentVer = ver[:i] // trim commit number (ex. v0.0.1-18-g2c63e8b -> v0.0.1)
+		return ver[:i]
 	}
-	return latest, currentVer == latest
+	return ver
 }
 
 func binaryURL() string {
 	if runtime.GOOS == "linux" && runtime.GOARCH == "amd64" {
-		return strings.Replace(config.UpdateCheckURL, "LATEST", "kaginawa.linux-x64.bz2", 1)
+		return strings.Replace(config().UpdateCheckURL, "LATEST", "kaginawa.linux-x64.bz2", 1)
 	}
 	if runtime.GOOS == "linux" && runtime.GOARCH == "arm" {
 		if machine, err := exec.Command("uname", "-m").Output(); err != nil {
 			if strings.HasPrefix(string(machine), "armv5") {
-				return strings.Replace(config.UpdateCheckURL, "LATEST", "kaginawa.linux-arm5.bz2", 1)
+				return strings.Replace(config().UpdateCheckURL, "LATEST", "kaginawa.linux-arm5.bz2", 1)
 			}
 			if strings.HasPrefix(string(machine), "armv6") {
-				return strings.Replace(config.UpdateCheckURL, "LATEST", "kaginawa.linux-arm6.bz2", 1)
+				return strings.Replace(config().UpdateCheckURL, "LATEST", "kaginawa.linux-arm6.bz2", 1)
 			}
 		}
-		return strings.Replace(config.UpdateCheckURL, "LATEST", "kaginawa.linux-arm7.bz2", 1)
+		return strings.Replace(config().UpdateCheckURL, "LATEST", "kaginawa.linux-arm7.bz2", 1)
 	}
 	if runtime.GOOS == "linux" && runtime.GOARCH == "arm64" {
-		return strings.Replace(config.UpdateCheckURL, "LATEST", "kaginawa.linux-arm8.bz2", 1)
+		return strings.Replace(config().UpdateCheckURL, "LATEST", "kaginawa.linux-arm8.bz2", 1)
 	}
 	if runtime.GOOS == "linux" && runtime.GOARCH == "riscv64" {
-		return strings.Replace(config.UpdateCheckURL, "LATEST", "kaginawa.linux-riscv64.bz2", 1)
+		return strings.Replace(config().UpdateCheckURL, "LATEST", "kaginawa.linux-riscv64.bz2", 1)
 	}
 	if runtime.GOOS == "darwin" && runtime.GOARCH == "amd64" {
-		return strings.Replace(config.UpdateCheckURL, "LATEST", "kaginawa.macos-x64.bz2", 1)
+		return strings.Replace(config().UpdateCheckURL, "LATEST", "kaginawa.macos-x64.bz2", 1)
 	}
 	if runtime.GOOS == "darwin" && runtime.GOARCH == "arm64" {
-		return strings.Replace(config.UpdateCheckURL, "LATEST", "kaginawa.macos-arm64.bz2", 1)
+		return strings.Replace(config().UpdateCheckURL, "LATEST", "kaginawa.macos-arm64.bz2", 1)
 	}
 	if runtime.GOOS == "windows" && runtime.GOARCH == "amd64" {
-		return strings.Replace(config.UpdateCheckURL, "LATEST", "kaginawa.exe.zip", 1)
+		return strings.Replace(config().UpdateCheckURL, "LATEST", "kaginawa.exe.zip", 1)
 	}
 	return ""
 }
@@ -152,6 +228,42 @@ func validate(content []byte, checksum []byte) bool {
 	return strings.HasPrefix(expected, actual)
 }
 
+// trustedUpdateKeys returns ed25519 public keys embedded by the build and configured by update_public_keys.
+func trustedUpdateKeys() []ed25519.PublicKey {
+	var keys []ed25519.PublicKey
+	for _, encoded := range append(strings.Split(updateKeys, ","), config().UpdatePublicKeys...) {
+		encoded = strings.TrimSpace(encoded)
+		if len(encoded) == 0 {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			log.Printf("invalid update public key: %s", encoded)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// verifySignature verifies the detached signature file, which contains base64 encoded ed25519 signatures line by line.
+// It succeeds if any of signatures is made by any of trusted keys, so that keys can be rotated.
+func verifySignature(content []byte, signatures []byte) error {
+	keys := trustedUpdateKeys()
+	for _, line := range strings.Split(string(signatures), "\n") {
+		sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(line))
+		if err != nil || len(sig) != ed25519.SignatureSize {
+			continue
+		}
+		for _, key := range keys {
+			if ed25519.Verify(key, content, sig) {
+				return nil
+			}
+		}
+	}
+	return errors.New("no valid signature by trusted keys")
+}
+
 func extract(content []byte) (string, error) {
 	// Create temp file
 	tempFile, err := os.CreateTemp("", "kgnw")
@@ -226,17 +338,7 @@ func replace(tempFileName string) error {
 }
 
 func restart() {
-	split := strings.Split(config.UpdateCommand, " ")
-	attrs := make([]string, len(split)-1)
-	if len(split) > 0 {
-		attrs = split[1:]
-	}
-	res, err := exec.Command(split[0], attrs...).Output()
-	if err != nil {
-		log.Printf("%s: %v", config.UpdateCommand, err)
-	} else {
-		log.Printf("%s: %s", config.UpdateCommand, res)
-	}
+	runCommand(config().UpdateCommand)
 }
 
 func safeRemove(name string) {